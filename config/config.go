@@ -4,21 +4,171 @@ const (
 	// MappingFile mapping file environment variable
 	MappingFile = "MAPPING_FILE"
 	MappingJson = "MAPPING_JSON"
-	CaCertFile  = "CA_CERT_FILE"
-	CertFile    = "CERT_FILE"
-	KeyFile     = "KEY_FILE"
+	// MappingDir directory with mapping files environment variable
+	MappingDir = "MAPPING_DIR"
+	// MappingReloadInterval seconds between mapping file change checks, 0 disables watching
+	MappingReloadInterval = "MAPPING_RELOAD_INTERVAL"
+	// LogBodyMaxLength number of message body characters logged at debug level, 0 logs the whole body
+	LogBodyMaxLength = "LOG_BODY_MAX_LENGTH"
+	// RedactHeaders comma separated message header names masked in logs
+	RedactHeaders = "REDACT_HEADERS"
+	// RedactFields comma separated JSON message body fields masked in logs
+	RedactFields = "REDACT_FIELDS"
+	CaCertFile   = "CA_CERT_FILE"
+	CertFile     = "CERT_FILE"
+	KeyFile      = "KEY_FILE"
 )
 
 // RabbitEntry RabbitMQ mapping entry
 type RabbitEntry struct {
-	Type          string   `json:"type"`
-	Name          string   `json:"name"`
-	ConnectionURL string   `json:"connection"`
-	ExchangeName  string   `json:"topic"`
-	ExchangeType  string   `json:"exchangeType"`
-	QueueName     string   `json:"queue"`
-	RoutingKey    string   `json:"routing"`
-	RoutingKeys   []string `json:"routingKeys"`
+	Type          string    `json:"type"`
+	Name          string    `json:"name"`
+	ConnectionURL string    `json:"connection"`
+	ExchangeName  string    `json:"topic"`
+	ExchangeType  string    `json:"exchangeType"`
+	QueueName     string    `json:"queue"`
+	RoutingKey    string    `json:"routing"`
+	RoutingKeys   []string  `json:"routingKeys"`
+	Tls           *TlsEntry `json:"tls"`
+	// Heartbeat heartbeat interval in seconds, defaults to 10
+	Heartbeat int `json:"heartbeat"`
+	// FrameSize maximum frame size in bytes, 0 is unlimited
+	FrameSize int `json:"frameSize"`
+	// DialTimeout connection and handshake timeout in seconds, defaults to 30
+	DialTimeout int `json:"dialTimeout"`
+	// Vhost overrides the virtual host from the connection url
+	Vhost string `json:"vhost"`
+	// ConnectionName shown in RabbitMQ management UI, defaults to rule name and hostname
+	ConnectionName string `json:"connectionName"`
+	// ConnectionURLs cluster node urls, tried after ConnectionURL on connection failure
+	ConnectionURLs []string `json:"connections"`
+	// Failover order of trying the nodes on every reconnect, ordered (default) or random
+	Failover string `json:"failover"`
+	// Reconnect backoff between reconnect attempts
+	Reconnect *ReconnectEntry `json:"reconnect"`
+	// QueueArguments queue declaration arguments, e.g. x-queue-type or x-max-length
+	QueueArguments map[string]interface{} `json:"queueArguments"`
+	// ExchangeArguments exchange declaration arguments, e.g. alternate-exchange
+	ExchangeArguments map[string]interface{} `json:"exchangeArguments"`
+	// Passive only verifies the queue exists and consumes from it, topology is managed outside of the forwarder
+	Passive bool `json:"passive"`
+	// DeadLetter dead-letter exchange and queue settings
+	DeadLetter *DeadLetterEntry `json:"deadLetter"`
+	// RateLimit maximal forwarding rate, consumption slows down when it is reached
+	RateLimit *RateLimitEntry `json:"rateLimit"`
+	// CircuitBreaker stops consuming while the destination keeps failing
+	CircuitBreaker *CircuitBreakerEntry `json:"circuitBreaker"`
+	// Dedup skips messages already forwarded within the TTL
+	Dedup *DedupEntry `json:"dedup"`
+	// Spool buffers messages on disk while the destination is unreachable
+	Spool *SpoolEntry `json:"spool"`
+	// Ordering forwards messages with the same key in order by concurrent workers
+	Ordering *OrderingEntry `json:"ordering"`
+}
+
+// OrderingEntry ordered forwarding, messages are partitioned by the routing key unless a
+// header or a JSON body field is set and every partition is forwarded in order by its worker
+type OrderingEntry struct {
+	// Workers partitions forwarded concurrently, defaults to 4
+	Workers int `json:"workers"`
+	// Header header holding the partition key, e.g. an entity id
+	Header string `json:"header"`
+	// Field dot separated JSON body field holding the partition key, e.g. order.id
+	Field string `json:"field"`
+}
+
+// SpoolEntry durable on-disk buffer, messages failing with retryable errors are written
+// to the spool and acked, the spool is drained in order when the destination recovers
+type SpoolEntry struct {
+	// Dir directory holding a spool per rule, e.g. a persistent volume
+	Dir string `json:"dir"`
+	// MaxSize megabytes of pending messages per rule, defaults to 1024
+	MaxSize int `json:"maxSize"`
+}
+
+// DedupEntry deduplication of redelivered messages, keyed by the AMQP message id unless
+// a header or a JSON body field is set
+type DedupEntry struct {
+	// Header header holding the deduplication key
+	Header string `json:"header"`
+	// Field dot separated JSON body field holding the deduplication key, e.g. event.id
+	Field string `json:"field"`
+	// TTL seconds a forwarded key is remembered, defaults to 3600
+	TTL int `json:"ttl"`
+	// Store memory (default) or dynamodb, shared by instances and kept across restarts
+	Store string `json:"store"`
+	// MaxEntries keys remembered by the memory store, least recently used are dropped, defaults to 100000
+	MaxEntries int `json:"maxEntries"`
+	// Table DynamoDB table with the string partition key id and the TTL attribute expiresAt
+	Table string `json:"table"`
+	// Endpoint overrides the DynamoDB endpoint, e.g. DynamoDB Local
+	Endpoint string `json:"endpoint"`
+}
+
+// CircuitBreakerEntry opens after the failure rate of the last messages reaches the threshold,
+// the consumer is cancelled until a trial message is forwarded successfully
+type CircuitBreakerEntry struct {
+	// FailureRate failed messages in percent which open the breaker, defaults to 50
+	FailureRate float64 `json:"failureRate"`
+	// Window number of last messages the failure rate is computed from, defaults to 20
+	Window int `json:"window"`
+	// OpenInterval seconds before a trial message probes the destination, defaults to 30
+	OpenInterval int `json:"openInterval"`
+}
+
+// RateLimitEntry token bucket limiting messages pushed to the destination
+type RateLimitEntry struct {
+	// MessagesPerSecond sustained forwarding rate, fractions allow less than one message per second
+	MessagesPerSecond float64 `json:"messagesPerSecond"`
+	// Burst messages forwarded at once after an idle period, also the prefetch count, defaults to 1
+	Burst int `json:"burst"`
+}
+
+// DeadLetterEntry dead-letter topology of the rule, rejected messages are routed to the dead-letter exchange
+type DeadLetterEntry struct {
+	// Exchange dead-letter exchange name, defaults to <queue>-dead-letter
+	Exchange string `json:"exchange"`
+	// ExchangeType dead-letter exchange type, defaults to fanout
+	ExchangeType string `json:"exchangeType"`
+	// Queue dead-letter queue name, defaults to <queue>-dead-letter
+	Queue string `json:"queue"`
+	// RoutingKey routing key of dead-lettered messages, also binds the dead-letter queue
+	RoutingKey string `json:"routingKey"`
+	// MessageTTL dead-letter queue message TTL in milliseconds, 0 keeps messages forever
+	MessageTTL int `json:"messageTtl"`
+	// MaxLength maximal number of messages in the dead-letter queue, 0 is unlimited
+	MaxLength int `json:"maxLength"`
+	// SkipDeclare dead-letter exchange and queue exist, only the regular queue arguments are set
+	SkipDeclare bool `json:"skipDeclare"`
+	// Annotate republishes failed messages to the dead-letter exchange with forwarding error headers
+	// instead of rejecting them
+	Annotate bool `json:"annotate"`
+	// Disabled rejected messages are dropped, no dead-letter exchange and queue
+	Disabled bool `json:"disabled"`
+}
+
+// ReconnectEntry exponential reconnect backoff, every wait is randomised between half and full interval
+type ReconnectEntry struct {
+	// InitialInterval interval before the first reconnect in seconds, defaults to 1
+	InitialInterval int `json:"initialInterval"`
+	// MaxInterval cap of the interval in seconds, defaults to 60
+	MaxInterval int `json:"maxInterval"`
+	// Multiplier interval growth after every failed attempt, defaults to 2
+	Multiplier float64 `json:"multiplier"`
+	// MaxAttempts failed attempts in a row after which the rule fails, 0 retries forever
+	MaxAttempts int `json:"maxAttempts"`
+}
+
+// TlsEntry RabbitMQ TLS settings, empty files fall back to CA_CERT_FILE, CERT_FILE and KEY_FILE
+type TlsEntry struct {
+	CaCertFile         string `json:"caCertFile"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	ServerName         string `json:"serverName"`
+	MinVersion         string `json:"minVersion"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	// AuthMechanism PLAIN (default) uses url credentials, EXTERNAL authenticates with the client certificate
+	AuthMechanism string `json:"authMechanism"`
 }
 
 // AmazonEntry SQS/SNS mapping entry
@@ -31,3 +181,12 @@ type AmazonEntry struct {
 type Options struct {
 	ForwardHeaders bool `json:"forwardHeaders"`
 }
+
+// URLs every configured connection url, ConnectionURL first
+func (e RabbitEntry) URLs() []string {
+	var urls []string
+	if e.ConnectionURL != "" {
+		urls = append(urls, e.ConnectionURL)
+	}
+	return append(urls, e.ConnectionURLs...)
+}
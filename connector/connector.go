@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/phorest/rabbit-amazon-forwarder/config"
 	log "github.com/sirupsen/logrus"
@@ -49,83 +51,176 @@ func (x *X509KeyPairLoader) LoadKeyPair(certFile string, keyFile string) (tls.Ce
 }
 
 type RabbitDialer interface {
-	Dial(connectionURL string) (*amqp.Connection, error)
+	Dial(connectionURL string, amqpConfig amqp.Config) (*amqp.Connection, error)
 }
 
 type BasicRabbitDialer struct {
 }
 
-func (s *BasicRabbitDialer) Dial(connectionURL string) (*amqp.Connection, error) {
-	return amqp.Dial(connectionURL)
+func (s *BasicRabbitDialer) Dial(connectionURL string, amqpConfig amqp.Config) (*amqp.Connection, error) {
+	return amqp.DialConfig(connectionURL, amqpConfig)
 }
 
 type TlsRabbitDialer interface {
-	DialTLS(connectionURL string, tlsConfig *tls.Config) (*amqp.Connection, error)
+	DialTLS(connectionURL string, amqpConfig amqp.Config) (*amqp.Connection, error)
 }
 
 type X509TlsDialer struct {
 }
 
-func (s *X509TlsDialer) DialTLS(connectionURL string, tlsConfig *tls.Config) (*amqp.Connection, error) {
-	return amqp.DialTLS(connectionURL, tlsConfig)
+func (s *X509TlsDialer) DialTLS(connectionURL string, amqpConfig amqp.Config) (*amqp.Connection, error) {
+	return amqp.DialConfig(connectionURL, amqpConfig)
+}
+
+// ExternalAuth SASL EXTERNAL mechanism, the broker authenticates the client by its TLS certificate
+type ExternalAuth struct {
+}
+
+// Mechanism returns "EXTERNAL"
+func (auth *ExternalAuth) Mechanism() string {
+	return ExternalMechanism
+}
+
+// Response is empty, identity is taken from the certificate
+func (auth *ExternalAuth) Response() string {
+	return ""
 }
 
 type RabbitConnector interface {
 	CreateConnection(connectionURL string) (*amqp.Connection, error)
+	ReleaseConnection(conn *amqp.Connection) error
 }
 
 type BasicRabbitConnector struct {
 	BasicRabbitDialer RabbitDialer
+	AmqpConfig        amqp.Config
 }
 
 func (c *BasicRabbitConnector) CreateConnection(connectionURL string) (*amqp.Connection, error) {
 	log.Info("Dialing in")
-	return c.BasicRabbitDialer.Dial(connectionURL)
+	return c.BasicRabbitDialer.Dial(connectionURL, c.AmqpConfig)
+}
+
+func (c *BasicRabbitConnector) ReleaseConnection(conn *amqp.Connection) error {
+	return conn.Close()
+}
+
+const (
+	// PlainMechanism authentication with url credentials
+	PlainMechanism = "PLAIN"
+	// ExternalMechanism authentication with client certificate
+	ExternalMechanism = "EXTERNAL"
+	defaultHeartbeat  = 10 * time.Second
+	defaultLocale     = "en_US"
+)
+
+// TlsVersions supported minimal TLS versions
+var TlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
 }
 
 type TlsRabbitConnector struct {
 	TlsConfig     *tls.Config
+	AmqpConfig    amqp.Config
+	Settings      config.TlsEntry
 	FileReader    FileReader
 	CertPoolMaker CertPoolMaker
 	KeyLoader     KeyLoader
 	TlsDialer     TlsRabbitDialer
+	configured    bool
+	mutex         sync.Mutex
 }
 
 func (c *TlsRabbitConnector) CreateConnection(connectionURL string) (*amqp.Connection, error) {
 	log.Info("Dialing in via TLS")
-	caCertFilePath := os.Getenv(config.CaCertFile)
-
-	if ca, err := c.FileReader.ReadFile(caCertFilePath); err == nil {
-		c.TlsConfig.RootCAs = c.CertPoolMaker.NewCertPoolWithAppendedCa(ca)
-	} else {
-		log.WithFields(log.Fields{
-			"error":           err.Error(),
-			config.CaCertFile: caCertFilePath}).Info("Error loading CA Cert file")
+	if err := c.configure(); err != nil {
 		return nil, err
 	}
+	amqpConfig := c.AmqpConfig
+	// amqp sets the server name of the dialed node unless configured, a copy keeps
+	// the shared config free of it for the other nodes and concurrent dials
+	amqpConfig.TLSClientConfig = c.TlsConfig.Clone()
+	if c.Settings.AuthMechanism == ExternalMechanism {
+		amqpConfig.SASL = []amqp.Authentication{&ExternalAuth{}}
+	}
+	return c.TlsDialer.DialTLS(connectionURL, amqpConfig)
+}
+
+func (c *TlsRabbitConnector) ReleaseConnection(conn *amqp.Connection) error {
+	return conn.Close()
+}
+
+// configure builds the TLS config once, it is reused on every reconnect
+func (c *TlsRabbitConnector) configure() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.configured {
+		return nil
+	}
+	caCertFilePath := settingOrEnv(c.Settings.CaCertFile, config.CaCertFile)
+	if caCertFilePath != "" {
+		if ca, err := c.FileReader.ReadFile(caCertFilePath); err == nil {
+			c.TlsConfig.RootCAs = c.CertPoolMaker.NewCertPoolWithAppendedCa(ca)
+		} else {
+			log.WithFields(log.Fields{
+				"error":           err.Error(),
+				config.CaCertFile: caCertFilePath}).Info("Error loading CA Cert file")
+			return err
+		}
+	}
 
-	certFilePath := os.Getenv(config.CertFile)
-	keyFilePath := os.Getenv(config.KeyFile)
+	certFilePath := settingOrEnv(c.Settings.CertFile, config.CertFile)
+	keyFilePath := settingOrEnv(c.Settings.KeyFile, config.KeyFile)
 	if cert, err := c.KeyLoader.LoadKeyPair(certFilePath, keyFilePath); err == nil {
-		c.TlsConfig.Certificates = append(c.TlsConfig.Certificates, cert)
+		c.TlsConfig.Certificates = []tls.Certificate{cert}
 	} else {
 		log.WithFields(log.Fields{
 			"error":         err.Error(),
 			config.CertFile: certFilePath,
 			config.KeyFile:  keyFilePath}).Info("Error loading client certificates")
+		// EXTERNAL authentication is not possible without client certificate
+		if c.Settings.AuthMechanism == ExternalMechanism {
+			return err
+		}
+	}
+
+	if c.Settings.ServerName != "" {
+		c.TlsConfig.ServerName = c.Settings.ServerName
+	}
+	if version, ok := TlsVersions[c.Settings.MinVersion]; ok {
+		c.TlsConfig.MinVersion = version
 	}
-	return c.TlsDialer.DialTLS(connectionURL, c.TlsConfig)
+	c.TlsConfig.InsecureSkipVerify = c.Settings.InsecureSkipVerify
+	c.configured = true
+	return nil
 }
 
-func CreateBasicRabbitConnector() *BasicRabbitConnector {
+func settingOrEnv(value string, key string) string {
+	if value != "" {
+		return value
+	}
+	return strings.TrimSpace(os.Getenv(key))
+}
+
+func CreateBasicRabbitConnector(entry config.RabbitEntry, ruleName string) *BasicRabbitConnector {
 	return &BasicRabbitConnector{
 		BasicRabbitDialer: &BasicRabbitDialer{},
+		AmqpConfig:        AmqpConfig(entry, ruleName),
 	}
 }
 
-func CreateTlsRabbitConnector() *TlsRabbitConnector {
+func CreateTlsRabbitConnector(entry config.RabbitEntry, ruleName string) *TlsRabbitConnector {
+	var tlsSettings config.TlsEntry
+	if entry.Tls != nil {
+		tlsSettings = *entry.Tls
+	}
 	return &TlsRabbitConnector{
 		TlsConfig:     new(tls.Config),
+		AmqpConfig:    AmqpConfig(entry, ruleName),
+		Settings:      tlsSettings,
 		FileReader:    &IOFileReader{},
 		CertPoolMaker: &X509CertPoolMaker{},
 		KeyLoader:     &X509KeyPairLoader{},
@@ -133,10 +228,53 @@ func CreateTlsRabbitConnector() *TlsRabbitConnector {
 	}
 }
 
-func CreateConnector(connectionURL string) RabbitConnector {
+// SchemeRabbitConnector picks basic or TLS connector by the url scheme when connecting,
+// used when the url is only known after resolving a secret reference
+type SchemeRabbitConnector struct {
+	BasicConnector RabbitConnector
+	TlsConnector   RabbitConnector
+}
+
+func (c *SchemeRabbitConnector) CreateConnection(connectionURL string) (*amqp.Connection, error) {
 	if strings.HasPrefix(connectionURL, "amqps") {
-		return CreateTlsRabbitConnector()
-	} else {
-		return CreateBasicRabbitConnector()
+		return c.TlsConnector.CreateConnection(connectionURL)
+	}
+	return c.BasicConnector.CreateConnection(connectionURL)
+}
+
+func (c *SchemeRabbitConnector) ReleaseConnection(conn *amqp.Connection) error {
+	return conn.Close()
+}
+
+// CreateConnector creates connector for the source connection urls and settings of the rule
+func CreateConnector(entry config.RabbitEntry, ruleName string) RabbitConnector {
+	switch urlsScheme(entry.URLs()) {
+	case "amqps":
+		return CreateTlsRabbitConnector(entry, ruleName)
+	case "amqp":
+		return CreateBasicRabbitConnector(entry, ruleName)
+	default:
+		return &SchemeRabbitConnector{
+			BasicConnector: CreateBasicRabbitConnector(entry, ruleName),
+			TlsConnector:   CreateTlsRabbitConnector(entry, ruleName),
+		}
+	}
+}
+
+// urlsScheme amqps or amqp when every url uses it, empty for secret references and mixed schemes
+func urlsScheme(urls []string) string {
+	scheme := ""
+	for i, connectionURL := range urls {
+		var current string
+		if strings.HasPrefix(connectionURL, "amqps") {
+			current = "amqps"
+		} else if strings.HasPrefix(connectionURL, "amqp") {
+			current = "amqp"
+		}
+		if i > 0 && current != scheme {
+			return ""
+		}
+		scheme = current
 	}
+	return scheme
 }
@@ -0,0 +1,193 @@
+package connector
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// DefaultPool connection pool shared by all consumers
+var DefaultPool = NewConnectionPool()
+
+// ConnectionPool shares connections to the same broker between consumers
+type ConnectionPool struct {
+	mutex       sync.Mutex
+	connections map[string]*sharedConnection
+	dialLocks   map[string]*sync.Mutex
+}
+
+type sharedConnection struct {
+	conn      *amqp.Connection
+	consumers int
+	blocking  amqp.Blocking
+}
+
+// BlockedReporter reports whether the broker blocked a connection, e.g. on a memory or disk alarm
+type BlockedReporter interface {
+	Blocked(conn *amqp.Connection) amqp.Blocking
+}
+
+// NewConnectionPool creates empty connection pool
+func NewConnectionPool() *ConnectionPool {
+	return &ConnectionPool{
+		connections: make(map[string]*sharedConnection),
+		dialLocks:   make(map[string]*sync.Mutex),
+	}
+}
+
+// Acquire returns the open connection for the key, only one consumer dials
+// when the connection is missing or dropped, others wait and reuse it
+func (p *ConnectionPool) Acquire(key string, dial func() (*amqp.Connection, error)) (*amqp.Connection, error) {
+	dialLock := p.dialLock(key)
+	dialLock.Lock()
+	defer dialLock.Unlock()
+
+	p.mutex.Lock()
+	if shared, ok := p.connections[key]; ok {
+		shared.consumers++
+		p.mutex.Unlock()
+		return shared.conn, nil
+	}
+	p.mutex.Unlock()
+
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	shared := &sharedConnection{conn: conn, consumers: 1}
+	p.mutex.Lock()
+	p.connections[key] = shared
+	p.mutex.Unlock()
+	go p.forgetOnClose(key, shared, conn.NotifyClose(make(chan *amqp.Error, 1)))
+	go p.watchBlocked(shared, conn.NotifyBlocked(make(chan amqp.Blocking, 1)))
+	return conn, nil
+}
+
+// Blocked last blocked notification of the pooled connection, inactive for other connections
+func (p *ConnectionPool) Blocked(conn *amqp.Connection) amqp.Blocking {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, shared := range p.connections {
+		if shared.conn == conn {
+			return shared.blocking
+		}
+	}
+	return amqp.Blocking{}
+}
+
+// Release drops the consumer reference, the connection is closed by its last consumer
+func (p *ConnectionPool) Release(conn *amqp.Connection) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, shared := range p.connections {
+		if shared.conn != conn {
+			continue
+		}
+		shared.consumers--
+		if shared.consumers > 0 {
+			return nil
+		}
+		delete(p.connections, key)
+		return conn.Close()
+	}
+	// connection already dropped and removed from the pool
+	return nil
+}
+
+// Size number of pooled connections
+func (p *ConnectionPool) Size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.connections)
+}
+
+func (p *ConnectionPool) dialLock(key string) *sync.Mutex {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.dialLocks[key]; !ok {
+		p.dialLocks[key] = &sync.Mutex{}
+	}
+	return p.dialLocks[key]
+}
+
+// forgetOnClose removes dropped connection so the next consumer reconnecting dials again
+func (p *ConnectionPool) forgetOnClose(key string, shared *sharedConnection, closed chan *amqp.Error) {
+	err := <-closed
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.connections[key] != shared {
+		return
+	}
+	delete(p.connections, key)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"consumers": shared.consumers,
+			"error":     err.Error()}).Warn("Shared connection dropped, consumers will reconnect")
+	}
+}
+
+// watchBlocked follows blocked notifications of the connection once for all its consumers
+// until the connection closes, the broker waits until the notification is received
+func (p *ConnectionPool) watchBlocked(shared *sharedConnection, blocked chan amqp.Blocking) {
+	for blocking := range blocked {
+		p.mutex.Lock()
+		shared.blocking = blocking
+		consumers := shared.consumers
+		p.mutex.Unlock()
+		if blocking.Active {
+			log.WithFields(log.Fields{
+				"consumers": consumers,
+				"reason":    blocking.Reason}).Warn("Shared connection blocked by broker")
+			continue
+		}
+		log.WithField("consumers", consumers).Info("Shared connection unblocked by broker")
+	}
+}
+
+// SharedRabbitConnector connects through the pool, consumers with the same broker url
+// and connection settings share one connection and open their own channels
+type SharedRabbitConnector struct {
+	Pool        *ConnectionPool
+	Connector   RabbitConnector
+	settingsKey string
+}
+
+// Share wraps the connector so its connections are shared through the default pool
+func Share(rabbitConnector RabbitConnector, entry config.RabbitEntry) *SharedRabbitConnector {
+	return &SharedRabbitConnector{
+		Pool:        DefaultPool,
+		Connector:   rabbitConnector,
+		settingsKey: settingsKey(entry),
+	}
+}
+
+func (c *SharedRabbitConnector) CreateConnection(connectionURL string) (*amqp.Connection, error) {
+	return c.Pool.Acquire(connectionURL+"|"+c.settingsKey, func() (*amqp.Connection, error) {
+		return c.Connector.CreateConnection(connectionURL)
+	})
+}
+
+func (c *SharedRabbitConnector) ReleaseConnection(conn *amqp.Connection) error {
+	return c.Pool.Release(conn)
+}
+
+// Blocked last blocked notification of the shared connection
+func (c *SharedRabbitConnector) Blocked(conn *amqp.Connection) amqp.Blocking {
+	return c.Pool.Blocked(conn)
+}
+
+// settingsKey connection settings which must match to share a connection,
+// connection name is not included, shared connection is named by the rule which opened it
+func settingsKey(entry config.RabbitEntry) string {
+	key, _ := json.Marshal(struct {
+		Tls         *config.TlsEntry
+		Heartbeat   int
+		FrameSize   int
+		DialTimeout int
+		Vhost       string
+	}{entry.Tls, entry.Heartbeat, entry.FrameSize, entry.DialTimeout, entry.Vhost})
+	return string(key)
+}
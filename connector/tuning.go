@@ -0,0 +1,69 @@
+package connector
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+	"github.com/streadway/amqp"
+)
+
+const (
+	product            = "rabbit-amazon-forwarder"
+	defaultDialTimeout = 30 * time.Second
+)
+
+// DefaultConnectionName connection name shown in RabbitMQ management UI: rule name and hostname
+func DefaultConnectionName(ruleName string) string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return ruleName
+	}
+	return ruleName + "@" + hostname
+}
+
+// AmqpConfig connection tuning for the source, defaults are the same as amqp.Dial,
+// the connection is named after the rule unless the source sets a name
+func AmqpConfig(entry config.RabbitEntry, ruleName string) amqp.Config {
+	heartbeat := defaultHeartbeat
+	if entry.Heartbeat > 0 {
+		heartbeat = time.Duration(entry.Heartbeat) * time.Second
+	}
+	dialTimeout := defaultDialTimeout
+	if entry.DialTimeout > 0 {
+		dialTimeout = time.Duration(entry.DialTimeout) * time.Second
+	}
+	connectionName := entry.ConnectionName
+	if connectionName == "" {
+		connectionName = DefaultConnectionName(ruleName)
+	}
+	return amqp.Config{
+		Heartbeat: heartbeat,
+		FrameSize: entry.FrameSize,
+		Vhost:     entry.Vhost,
+		Locale:    defaultLocale,
+		Dial:      timeoutDialer(dialTimeout),
+		Properties: amqp.Table{
+			"product":         product,
+			"platform":        "golang",
+			"connection_name": connectionName,
+		},
+	}
+}
+
+// timeoutDialer dials with timeout and sets the deadline for TLS and AMQP handshake,
+// amqp clears the deadline once connected
+func timeoutDialer(timeout time.Duration) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := net.DialTimeout(network, addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
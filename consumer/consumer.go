@@ -1,9 +1,144 @@
 package consumer
 
-import "github.com/phorest/rabbit-amazon-forwarder/forwarder"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/forwarder"
+)
+
+const (
+	// ReplayToExchange replays dead-lettered messages to the exchange they were published to
+	ReplayToExchange = "exchange"
+	// ReplayToForwarder pushes dead-lettered messages directly through the rule's forwarder
+	ReplayToForwarder = "forwarder"
+	// DefaultInspectLimit dead-lettered messages returned by inspection when no limit is given
+	DefaultInspectLimit = 10
+)
 
 // Client intarface for consuming messages
+// Start receives check, stop and pause channels from the supervisor,
+// sending true on pause channel pauses consuming and false resumes it
 type Client interface {
 	Name() string
-	Start(forwarder.Client, chan bool, chan bool) error
+	Start(forwarder.Client, chan bool, chan bool, chan bool) error
+}
+
+// NodeReporter optional interface of consumers connecting to one of multiple broker nodes
+type NodeReporter interface {
+	// Node currently connected broker node, empty when not connected
+	Node() string
+}
+
+// StateReporter optional interface of consumers reporting their connection state
+type StateReporter interface {
+	// State connection state with the reason reported by the broker, e.g. "blocked: low on memory"
+	State() string
+}
+
+// BreakerReporter optional interface of consumers with a circuit breaker
+type BreakerReporter interface {
+	// Breaker circuit breaker state, e.g. "open", empty when not configured
+	Breaker() string
+}
+
+// SpoolReporter optional interface of consumers buffering messages on disk
+type SpoolReporter interface {
+	// SpoolStats pending messages of the spool, false when not configured
+	SpoolStats() (SpoolStats, bool)
+}
+
+// SpoolStats pending and failed spooled messages
+type SpoolStats struct {
+	Messages int   `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"maxBytes"`
+	// Failed messages rejected by the destination while draining, kept in the failed log
+	Failed int `json:"failed"`
+}
+
+// Replayer optional interface of consumers able to replay dead-lettered messages
+type Replayer interface {
+	Replay(forwarder.Client, ReplayOptions) (ReplayResult, error)
+}
+
+// ReplayOptions dead-letter replay options
+type ReplayOptions struct {
+	// Limit maximal number of replayed messages, 0 replays all
+	Limit int
+	// Headers only messages with all of the header values are replayed
+	Headers map[string]string
+	// DryRun lists the messages which would be replayed, the queue is not changed
+	DryRun bool
+	// Target ReplayToExchange (default) or ReplayToForwarder
+	Target string
+}
+
+// ReplayResult replayed and skipped messages, replayed messages are listed on dry run
+type ReplayResult struct {
+	Replayed int               `json:"replayed"`
+	Skipped  int               `json:"skipped"`
+	DryRun   bool              `json:"dryRun"`
+	Messages []ReplayedMessage `json:"messages,omitempty"`
+}
+
+// ReplayedMessage preview of a replayed message
+type ReplayedMessage struct {
+	MessageID  string                 `json:"messageId"`
+	RoutingKey string                 `json:"routingKey"`
+	Headers    map[string]interface{} `json:"headers"`
+	Body       string                 `json:"body"`
+}
+
+// Inspector optional interface of consumers able to peek at dead-lettered messages,
+// the messages stay in the dead-letter queue
+type Inspector interface {
+	Inspect(limit int) ([]DeadLetteredMessage, error)
+}
+
+// DeadLetteredMessage dead-lettered message with its dead-letter history and forwarding error
+type DeadLetteredMessage struct {
+	MessageID  string                 `json:"messageId"`
+	Exchange   string                 `json:"exchange"`
+	RoutingKey string                 `json:"routingKey"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Headers    map[string]interface{} `json:"headers"`
+	Body       string                 `json:"body"`
+	// Deaths broker dead-letter history, most recent first
+	Deaths []Death `json:"deaths,omitempty"`
+	// Error forwarding error of annotated messages
+	Error *ForwardingError `json:"error,omitempty"`
+}
+
+// Death dead-letter history entry recorded by the broker
+type Death struct {
+	Queue       string    `json:"queue"`
+	Exchange    string    `json:"exchange"`
+	RoutingKeys []string  `json:"routingKeys"`
+	Reason      string    `json:"reason"`
+	Count       int64     `json:"count"`
+	Time        time.Time `json:"time"`
+}
+
+// ForwardingError forwarding error annotation of a dead-lettered message
+type ForwardingError struct {
+	Message   string    `json:"message"`
+	Class     string    `json:"class"`
+	Forwarder string    `json:"forwarder"`
+	Queue     string    `json:"queue"`
+	Time      time.Time `json:"time"`
+}
+
+// ParseHeaderFilter parses name:value header filters
+func ParseHeaderFilter(filters []string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, filter := range filters {
+		parts := strings.SplitN(filter, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header filter %q, expected name:value", filter)
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
 }
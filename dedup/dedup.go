@@ -0,0 +1,87 @@
+package dedup
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+	"github.com/phorest/rabbit-amazon-forwarder/jsonfield"
+)
+
+const (
+	// MemoryStore in-memory LRU store of a single instance
+	MemoryStore = "memory"
+	// DynamoDBStore DynamoDB table shared by instances
+	DynamoDBStore = "dynamodb"
+	// DefaultTTL seconds a forwarded key is remembered
+	DefaultTTL = 3600
+	// DefaultMaxEntries keys remembered by the memory store
+	DefaultMaxEntries = 100000
+)
+
+// Store remembers forwarded message keys until the TTL expires
+type Store interface {
+	// Seen whether the key was recorded and has not expired
+	Seen(key string) (bool, error)
+	// Record remembers the key
+	Record(key string) error
+}
+
+// Client extracts deduplication keys and checks them against the store,
+// keys are namespaced by forwarder so a shared store can serve many rules
+type Client struct {
+	header string
+	field  string
+	store  Store
+}
+
+// New creates deduplication client, nil when deduplication is not configured
+func New(entry *config.DedupEntry, dynamoDBClient ...dynamodbiface.DynamoDBAPI) *Client {
+	if entry == nil {
+		return nil
+	}
+	ttl := DefaultTTL * time.Second
+	if entry.TTL > 0 {
+		ttl = time.Duration(entry.TTL) * time.Second
+	}
+	var store Store
+	switch entry.Store {
+	case DynamoDBStore:
+		store = newDynamoDBStore(entry.Table, entry.Endpoint, ttl, dynamoDBClient...)
+	default:
+		maxEntries := DefaultMaxEntries
+		if entry.MaxEntries > 0 {
+			maxEntries = entry.MaxEntries
+		}
+		store = newMemoryStore(ttl, maxEntries)
+	}
+	return &Client{entry.Header, entry.Field, store}
+}
+
+// Key deduplication key of the message, empty when the message has none
+func (c *Client) Key(messageID string, headers map[string]interface{}, body []byte) string {
+	switch {
+	case c == nil:
+		return ""
+	case c.header != "":
+		if value, ok := headers[c.header]; ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	case c.field != "":
+		return jsonfield.Value(body, c.field)
+	}
+	return messageID
+}
+
+// Seen whether the forwarder already forwarded the message with the key
+func (c *Client) Seen(forwarderName string, key string) (bool, error) {
+	return c.store.Seen(forwarderName + "/" + key)
+}
+
+// Record remembers the message with the key was forwarded
+func (c *Client) Record(forwarderName string, key string) error {
+	return c.store.Record(forwarderName + "/" + key)
+}
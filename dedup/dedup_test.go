@@ -0,0 +1,127 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+)
+
+func TestKey(t *testing.T) {
+	headers := map[string]interface{}{"x-event-id": "abc", "x-sequence": int64(7)}
+	body := []byte(`{"event":{"id":"evt-1","sequence":12345678901234},"tags":["a"]}`)
+	scenarios := []struct {
+		name  string
+		entry config.DedupEntry
+		key   string
+	}{
+		{"message id", config.DedupEntry{}, "msg-1"},
+		{"header", config.DedupEntry{Header: "x-event-id"}, "abc"},
+		{"number header", config.DedupEntry{Header: "x-sequence"}, "7"},
+		{"missing header", config.DedupEntry{Header: "x-missing"}, ""},
+		{"field", config.DedupEntry{Field: "event.id"}, "evt-1"},
+		{"number field", config.DedupEntry{Field: "event.sequence"}, "12345678901234"},
+		{"object field", config.DedupEntry{Field: "event"}, ""},
+		{"missing field", config.DedupEntry{Field: "event.id.value"}, ""},
+	}
+	for _, scenario := range scenarios {
+		client := New(&scenario.entry)
+		if key := client.Key("msg-1", headers, body); key != scenario.key {
+			t.Errorf("%s: wrong key, expected:%q, got:%q", scenario.name, scenario.key, key)
+		}
+	}
+	if key := New(&config.DedupEntry{Field: "id"}).Key("msg-1", nil, []byte("not json")); key != "" {
+		t.Errorf("invalid JSON should have no key, got:%q", key)
+	}
+	if key := New(nil).Key("msg-1", headers, body); key != "" {
+		t.Errorf("disabled deduplication should have no key, got:%q", key)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newMemoryStore(time.Minute, 2)
+	store.now = func() time.Time { return now }
+	store.Record("a")
+	store.Record("b")
+	if seen, _ := store.Seen("a"); !seen {
+		t.Error("recorded key should be seen")
+	}
+	// b is the least recently used
+	store.Record("c")
+	if seen, _ := store.Seen("b"); seen {
+		t.Error("least recently used key should be dropped")
+	}
+	if seen, _ := store.Seen("c"); !seen {
+		t.Error("recorded key should be seen")
+	}
+	now = now.Add(time.Minute)
+	if seen, _ := store.Seen("a"); seen {
+		t.Error("expired key should not be seen")
+	}
+	if len(store.entries) != 1 || store.order.Len() != 1 {
+		t.Errorf("expired key should be dropped, got:%d entries", len(store.entries))
+	}
+}
+
+func TestDynamoDBStore(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock := &mockDynamoDB{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	client := New(&config.DedupEntry{Store: DynamoDBStore, Table: "forwarded", TTL: 60}, mock)
+	client.store.(*dynamoDBStore).now = func() time.Time { return now }
+
+	if seen, err := client.Seen("sns", "msg-1"); seen || err != nil {
+		t.Errorf("unknown key should not be seen, got:%t %v", seen, err)
+	}
+	if err := client.Record("sns", "msg-1"); err != nil {
+		t.Fatal(err)
+	}
+	item := mock.items["sns/msg-1"]
+	if item == nil || *item[ExpiresAttribute].N != fmt.Sprint(now.Unix()+60) {
+		t.Errorf("wrong recorded item, got:%v", mock.items)
+	}
+	if seen, err := client.Seen("sns", "msg-1"); !seen || err != nil {
+		t.Errorf("recorded key should be seen, got:%t %v", seen, err)
+	}
+	if seen, _ := client.Seen("sqs", "msg-1"); seen {
+		t.Error("keys of other forwarders should not be seen")
+	}
+	// expired items may not be deleted yet
+	now = now.Add(time.Minute)
+	if seen, _ := client.Seen("sns", "msg-1"); seen {
+		t.Error("expired key should not be seen")
+	}
+	mock.err = errors.New("throttled")
+	if _, err := client.Seen("sns", "msg-1"); err == nil {
+		t.Error("store error should be returned")
+	}
+}
+
+type mockDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+	err   error
+}
+
+func (m *mockDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if *input.TableName != "forwarded" || !*input.ConsistentRead {
+		return nil, errors.New("wrong table or inconsistent read")
+	}
+	return &dynamodb.GetItemOutput{Item: m.items[*input.Key[KeyAttribute].S]}, nil
+}
+
+func (m *mockDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.items[*input.Item[KeyAttribute].S] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
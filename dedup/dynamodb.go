@@ -0,0 +1,71 @@
+package dedup
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	// KeyAttribute string partition key of the DynamoDB table
+	KeyAttribute = "id"
+	// ExpiresAttribute epoch seconds the key expires at, set as the table's TTL attribute
+	ExpiresAttribute = "expiresAt"
+)
+
+// dynamoDBStore keys in a DynamoDB table, DynamoDB deletes expired items
+// with a delay so the expiry is checked on lookup
+type dynamoDBStore struct {
+	client dynamodbiface.DynamoDBAPI
+	table  string
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+func newDynamoDBStore(table string, endpoint string, ttl time.Duration, dynamoDBClient ...dynamodbiface.DynamoDBAPI) *dynamoDBStore {
+	var client dynamodbiface.DynamoDBAPI
+	if len(dynamoDBClient) > 0 {
+		client = dynamoDBClient[0]
+	} else if endpoint != "" {
+		client = dynamodb.New(session.Must(session.NewSession()), aws.NewConfig().WithEndpoint(endpoint))
+	} else {
+		client = dynamodb.New(session.Must(session.NewSession()))
+	}
+	return &dynamoDBStore{client, table, ttl, time.Now}
+}
+
+func (s *dynamoDBStore) Seen(key string) (bool, error) {
+	resp, err := s.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]*dynamodb.AttributeValue{KeyAttribute: {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+	expires, ok := resp.Item[ExpiresAttribute]
+	if !ok || expires.N == nil {
+		return false, nil
+	}
+	expiresAt, err := strconv.ParseInt(*expires.N, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	return s.now().Unix() < expiresAt, nil
+}
+
+func (s *dynamoDBStore) Record(key string) error {
+	expiresAt := strconv.FormatInt(s.now().Add(s.ttl).Unix(), 10)
+	_, err := s.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			KeyAttribute:     {S: aws.String(key)},
+			ExpiresAttribute: {N: aws.String(expiresAt)},
+		},
+	})
+	return err
+}
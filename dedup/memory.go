@@ -0,0 +1,60 @@
+package dedup
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// memoryStore LRU of forwarded keys, expired keys are dropped when looked up
+type memoryStore struct {
+	mutex      sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List
+	now        func() time.Time
+}
+
+type memoryEntry struct {
+	key     string
+	expires time.Time
+}
+
+func newMemoryStore(ttl time.Duration, maxEntries int) *memoryStore {
+	return &memoryStore{ttl: ttl, maxEntries: maxEntries, entries: make(map[string]*list.Element), order: list.New(), now: time.Now}
+}
+
+func (s *memoryStore) Seen(key string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return false, nil
+	}
+	if !s.now().Before(element.Value.(*memoryEntry).expires) {
+		s.order.Remove(element)
+		delete(s.entries, key)
+		return false, nil
+	}
+	s.order.MoveToFront(element)
+	return true, nil
+}
+
+func (s *memoryStore) Record(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	expires := s.now().Add(s.ttl)
+	if element, ok := s.entries[key]; ok {
+		element.Value.(*memoryEntry).expires = expires
+		s.order.MoveToFront(element)
+		return nil
+	}
+	s.entries[key] = s.order.PushFront(&memoryEntry{key, expires})
+	if s.order.Len() > s.maxEntries {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryEntry).key)
+	}
+	return nil
+}
@@ -5,8 +5,65 @@ const (
 	EmptyMessageError = "message is empty"
 )
 
+// retryableClasses AWS error codes of outages and throttling, the message may be forwarded later
+var retryableClasses = map[string]bool{
+	"RequestError":                           true,
+	"RequestTimeout":                         true,
+	"RequestTimeoutException":                true,
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"TooManyRequestsException":               true,
+	"RequestThrottled":                       true,
+	"RequestLimitExceeded":                   true,
+	"ProvisionedThroughputExceededException": true,
+	"ServiceUnavailable":                     true,
+	"ServiceUnavailableException":            true,
+	"ServiceException":                       true,
+	"InternalError":                          true,
+	"InternalFailure":                        true,
+	"InternalServerError":                    true,
+	"EC2ThrottledException":                  true,
+}
+
 // Client interface to forwarding messages
 type Client interface {
 	Name() string
 	Push(messageBody string, headers map[string]interface{}) error
 }
+
+// Error forwarding error with a class, e.g. Lambda function error
+type Error struct {
+	Class   string
+	Message string
+}
+
+func (e Error) Error() string {
+	return e.Message
+}
+
+// ErrorClass class of a forwarding error, AWS error code when available
+func ErrorClass(err error) string {
+	switch e := err.(type) {
+	case Error:
+		return e.Class
+	case interface {
+		Code() string
+	}:
+		return e.Code()
+	}
+	if err.Error() == EmptyMessageError {
+		return "EmptyMessage"
+	}
+	return "Unknown"
+}
+
+// Retryable whether the destination was unreachable or overloaded, as opposed to rejecting the message
+func Retryable(err error) bool {
+	if failure, ok := err.(interface {
+		StatusCode() int
+	}); ok && failure.StatusCode() >= 500 {
+		return true
+	}
+	return retryableClasses[ErrorClass(err)]
+}
@@ -0,0 +1,64 @@
+package forwarder
+
+import (
+	"errors"
+	"testing"
+)
+
+type codeError struct {
+	code string
+}
+
+func (e codeError) Error() string {
+	return e.code + ": message"
+}
+
+func (e codeError) Code() string {
+	return e.code
+}
+
+func TestErrorClass(t *testing.T) {
+	scenarios := []struct {
+		err   error
+		class string
+	}{
+		{Error{Class: "FunctionError", Message: "Unhandled"}, "FunctionError"},
+		{codeError{"ThrottlingException"}, "ThrottlingException"},
+		{errors.New(EmptyMessageError), "EmptyMessage"},
+		{errors.New("connection reset"), "Unknown"},
+	}
+	for _, scenario := range scenarios {
+		if class := ErrorClass(scenario.err); class != scenario.class {
+			t.Errorf("wrong class of %s, expected:%s, got:%s", scenario.err.Error(), scenario.class, class)
+		}
+	}
+}
+
+type statusError struct {
+	codeError
+	status int
+}
+
+func (e statusError) StatusCode() int {
+	return e.status
+}
+
+func TestRetryable(t *testing.T) {
+	scenarios := []struct {
+		err       error
+		retryable bool
+	}{
+		{codeError{"RequestError"}, true},
+		{codeError{"ThrottlingException"}, true},
+		{statusError{codeError{"UnknownError"}, 503}, true},
+		{statusError{codeError{"AccessDeniedException"}, 403}, false},
+		{codeError{"NotFound"}, false},
+		{Error{Class: "FunctionError", Message: "Unhandled"}, false},
+		{errors.New(EmptyMessageError), false},
+	}
+	for _, scenario := range scenarios {
+		if retryable := Retryable(scenario.err); retryable != scenario.retryable {
+			t.Errorf("wrong retryable of %s, expected:%t, got:%t", scenario.err.Error(), scenario.retryable, retryable)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package jsonfield
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// Value string or number value of the dot separated field of the JSON body, empty when
+// the body is not JSON or the field is missing or holds another type
+func Value(body []byte, path string) string {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return ""
+	}
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if value, ok = object[name]; !ok {
+			return ""
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
@@ -0,0 +1,25 @@
+package jsonfield
+
+import "testing"
+
+func TestValue(t *testing.T) {
+	body := []byte(`{"event":{"id":"evt-1","sequence":12345678901234,"tags":["a"]}}`)
+	scenarios := []struct {
+		path  string
+		body  []byte
+		value string
+	}{
+		{"event.id", body, "evt-1"},
+		{"event.sequence", body, "12345678901234"},
+		{"event", body, ""},
+		{"event.tags", body, ""},
+		{"event.id.value", body, ""},
+		{"missing", body, ""},
+		{"id", []byte("not json"), ""},
+	}
+	for _, scenario := range scenarios {
+		if value := Value(scenario.body, scenario.path); value != scenario.value {
+			t.Errorf("wrong value of %s, expected:%s, got:%s", scenario.path, scenario.value, value)
+		}
+	}
+}
@@ -16,6 +16,8 @@ import (
 const (
 	// Type forwarder type
 	Type = "Lambda"
+	// FunctionErrorClass error class of errors raised by the function
+	FunctionErrorClass = "FunctionError"
 )
 
 // Forwarder forwarding client
@@ -80,7 +82,7 @@ func (f Forwarder) Push(messageBody string, headers map[string]interface{}) erro
 		log.WithFields(log.Fields{
 			"forwarderName": f.Name(),
 			"functionError": *resp.FunctionError}).Errorf("Could not forward message")
-		return errors.New(*resp.FunctionError)
+		return forwarder.Error{Class: FunctionErrorClass, Message: *resp.FunctionError}
 	}
 	log.WithFields(log.Fields{
 		"forwarderName": f.Name(),
@@ -0,0 +1,78 @@
+package mapping
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var mappingExtensions = []string{".json", ".yaml", ".yml"}
+
+// DirectoryFiles lists JSON and YAML mapping files in the directory sorted by name,
+// hidden entries such as Kubernetes ConfigMap "..data" links are skipped
+func DirectoryFiles(dirPath string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !hasMappingExtension(name) {
+			continue
+		}
+		filePath := filepath.Join(dirPath, name)
+		// follow symlinks, ConfigMap files are links to the current data directory
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			continue
+		}
+		files = append(files, filePath)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// loadDirectory merges rules from every mapping file in the directory
+func loadDirectory(dirPath string) (rules, error) {
+	log.WithField("mappingDir", dirPath).Info("Loading mapping directory")
+	files, err := DirectoryFiles(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var rulesList rules
+	var labels []string
+	for _, filePath := range files {
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		fileRules, err := decodeRules(data, filePath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filepath.Base(filePath), err.Error())
+		}
+		for i := range fileRules {
+			labels = append(labels, fmt.Sprintf("%s: rule[%d]", filepath.Base(filePath), i))
+		}
+		rulesList = append(rulesList, fileRules...)
+	}
+	return rulesList, validate(rulesList, labels...)
+}
+
+func hasMappingExtension(name string) bool {
+	extension := strings.ToLower(filepath.Ext(name))
+	for _, e := range mappingExtensions {
+		if extension == e {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package mapping
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// variablePattern matches ${VAR} and ${VAR:-default}
+var variablePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// decodeRules decodes JSON or YAML mapping and expands environment variables in string fields
+func decodeRules(data []byte, filePath string) (rules, error) {
+	var document interface{}
+	if isYAML(data, filePath) {
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, err
+		}
+		document = normalizeYAML(document)
+	} else if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	var missing []string
+	document = expandVariables(document, &missing)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	expanded, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var rulesList rules
+	if err = json.Unmarshal(expanded, &rulesList); err != nil {
+		return nil, err
+	}
+	return rulesList, nil
+}
+
+// isYAML detects the format by file extension, falling back to the content
+func isYAML(data []byte, filePath string) bool {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml":
+		return true
+	case ".json":
+		return false
+	}
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) > 0 && trimmed[0] != '[' && trimmed[0] != '{'
+}
+
+// normalizeYAML converts YAML maps to JSON compatible maps
+func normalizeYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[fmt.Sprint(key)] = normalizeYAML(item)
+		}
+		return normalized
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeYAML(item)
+		}
+	}
+	return value
+}
+
+func expandVariables(value interface{}, missing *[]string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return expandString(v, missing)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = expandVariables(item, missing)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = expandVariables(item, missing)
+		}
+	}
+	return value
+}
+
+func expandString(value string, missing *[]string) string {
+	return variablePattern.ReplaceAllStringFunc(value, func(reference string) string {
+		groups := variablePattern.FindStringSubmatch(reference)
+		if variable, ok := os.LookupEnv(groups[1]); ok && (variable != "" || groups[2] == "") {
+			return variable
+		}
+		if groups[2] != "" {
+			return groups[3]
+		}
+		*missing = append(*missing, groups[1])
+		return ""
+	})
+}
@@ -1,7 +1,6 @@
 package mapping
 
 import (
-	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"os"
@@ -20,10 +19,11 @@ import (
 
 type rules []ForwardingRule
 
-type ForwardingRule struct { 
+// ForwardingRule mapping entry with source, destination and options
+type ForwardingRule struct {
 	Source      config.RabbitEntry `json:"source"`
 	Destination config.AmazonEntry `json:"destination"`
-	Options 	config.Options `json:"options"`
+	Options     config.Options     `json:"options"`
 }
 
 // Client mapping client
@@ -33,7 +33,7 @@ type Client struct {
 
 // Helper interface for creating consumers and forwaders
 type Helper interface {
-	createConsumer(entry config.RabbitEntry) consumer.Client
+	createConsumer(entry config.RabbitEntry, ruleName string) consumer.Client
 	createForwarder(entry config.AmazonEntry, options config.Options) forwarder.Client
 }
 
@@ -41,6 +41,7 @@ type Helper interface {
 type ConsumerForwarderMapping struct {
 	Consumer  consumer.Client
 	Forwarder forwarder.Client
+	Rule      ForwardingRule
 }
 
 type helperImpl struct{}
@@ -58,23 +59,40 @@ func New(helpers ...Helper) Client {
 // Load loads mappings
 func (c Client) Load() ([]ConsumerForwarderMapping, error) {
 	var consumerForwarderMapping []ConsumerForwarderMapping
-	data, err := c.loadMappings()
+	rulesList, err := c.loadRules()
 	if err != nil {
 		return consumerForwarderMapping, err
 	}
-	var rulesList rules
-	if err = json.Unmarshal(data, &rulesList); err != nil {
-		return consumerForwarderMapping, err
-	}
 	log.Info("Loading consumer - forwarder pairs")
 	for _, rule := range rulesList {
-		consumer := c.helper.createConsumer(rule.Source)
+		consumer := c.helper.createConsumer(rule.Source, rule.Destination.Name)
 		forwarder := c.helper.createForwarder(rule.Destination, rule.Options)
-		consumerForwarderMapping = append(consumerForwarderMapping, ConsumerForwarderMapping{consumer, forwarder})
+		consumerForwarderMapping = append(consumerForwarderMapping, ConsumerForwarderMapping{consumer, forwarder, rule})
 	}
 	return consumerForwarderMapping, nil
 }
 
+// Validate checks the mapping without creating consumers and forwarders
+func (c Client) Validate() error {
+	_, err := c.loadRules()
+	return err
+}
+
+func (c Client) loadRules() (rules, error) {
+	if dirPath := os.Getenv(config.MappingDir); dirPath != "" && os.Getenv(config.MappingFile) == "" {
+		return loadDirectory(dirPath)
+	}
+	data, err := c.loadMappings()
+	if err != nil {
+		return nil, err
+	}
+	rulesList, err := decodeRules(data, os.Getenv(config.MappingFile))
+	if err != nil {
+		return nil, err
+	}
+	return rulesList, validate(rulesList)
+}
+
 func (c Client) loadMappings() ([]byte, error) {
 	filePath := os.Getenv(config.MappingFile)
 	if filePath != "" {
@@ -83,20 +101,20 @@ func (c Client) loadMappings() ([]byte, error) {
 	} else {
 		jsonConfig := os.Getenv(config.MappingJson)
 		if jsonConfig == "" {
-			return nil, errors.New("must provide either a mapping file or mapping json")
+			return nil, errors.New("must provide either a mapping file, mapping directory or mapping json")
 		}
 
 		return []byte(jsonConfig), nil
 	}
 }
 
-func (h helperImpl) createConsumer(entry config.RabbitEntry) consumer.Client {
+func (h helperImpl) createConsumer(entry config.RabbitEntry, ruleName string) consumer.Client {
 	log.WithFields(log.Fields{
 		"consumerType": entry.Type,
 		"consumerName": entry.Name}).Info("Creating consumer")
 	switch entry.Type {
 	case rabbitmq.Type:
-		rabbitConnector := connector.CreateConnector(entry.ConnectionURL)
+		rabbitConnector := connector.Share(connector.CreateConnector(entry, ruleName), entry)
 		return rabbitmq.CreateConsumer(entry, rabbitConnector)
 	}
 	return nil
@@ -0,0 +1,285 @@
+package mapping
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+	"github.com/phorest/rabbit-amazon-forwarder/connector"
+	"github.com/phorest/rabbit-amazon-forwarder/dedup"
+	"github.com/phorest/rabbit-amazon-forwarder/lambda"
+	"github.com/phorest/rabbit-amazon-forwarder/rabbitmq"
+	"github.com/phorest/rabbit-amazon-forwarder/sns"
+	"github.com/phorest/rabbit-amazon-forwarder/sqs"
+)
+
+// minFrameSize minimal AMQP frame size
+const minFrameSize = 4096
+
+var exchangeTypes = []string{"direct", "fanout", "topic", "headers"}
+
+// ValidationError every problem found in the mapping
+type ValidationError struct {
+	Problems []string
+}
+
+func (e ValidationError) Error() string {
+	return "invalid mapping: " + strings.Join(e.Problems, "; ")
+}
+
+type validator struct {
+	problems []string
+	labels   []string
+}
+
+// label rule reference used in problems, defaults to the rule index
+func (v *validator) label(index int) string {
+	if index < len(v.labels) {
+		return v.labels[index]
+	}
+	return fmt.Sprintf("rule[%d]", index)
+}
+
+func (v *validator) add(index int, field string, format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf("%s.%s: %s", v.label(index), field, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) required(index int, field string, value string) {
+	if strings.TrimSpace(value) == "" {
+		v.add(index, field, "is required")
+	}
+}
+
+func (v *validator) oneOf(index int, field string, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.add(index, field, "unknown value %q, expected one of: %s", value, strings.Join(allowed, ", "))
+}
+
+func (v *validator) notNegative(index int, field string, value int) {
+	if value < 0 {
+		v.add(index, field, "must not be negative")
+	}
+}
+
+// validate checks every rule and reports all problems at once,
+// labels optionally name the rules e.g. with the file they come from
+func validate(rulesList rules, labels ...string) error {
+	v := &validator{labels: labels}
+	if len(rulesList) == 0 {
+		v.problems = append(v.problems, "no rules defined")
+	}
+	names := make(map[string]int)
+	for i, rule := range rulesList {
+		source := rule.Source
+		v.oneOf(i, "source.type", source.Type, rabbitmq.Type)
+		v.required(i, "source.name", source.Name)
+		if len(source.URLs()) == 0 {
+			v.add(i, "source.connection", "is required")
+		}
+		for j, connectionURL := range source.ConnectionURLs {
+			v.required(i, fmt.Sprintf("source.connections[%d]", j), connectionURL)
+		}
+		if source.Failover != "" {
+			v.oneOf(i, "source.failover", source.Failover, rabbitmq.FailoverOrdered, rabbitmq.FailoverRandom)
+		}
+		if source.Passive {
+			v.passive(i, source)
+		} else {
+			v.topology(i, source)
+		}
+		if source.Tls != nil {
+			v.tls(i, source)
+		}
+		v.notNegative(i, "source.heartbeat", source.Heartbeat)
+		v.notNegative(i, "source.dialTimeout", source.DialTimeout)
+		if source.FrameSize != 0 && source.FrameSize < minFrameSize {
+			v.add(i, "source.frameSize", "must be at least %d bytes", minFrameSize)
+		}
+		if source.Reconnect != nil {
+			v.reconnect(i, *source.Reconnect)
+		}
+		if source.RateLimit != nil {
+			v.rateLimit(i, *source.RateLimit)
+		}
+		if source.CircuitBreaker != nil {
+			v.circuitBreaker(i, *source.CircuitBreaker)
+		}
+		if source.Dedup != nil {
+			v.dedup(i, *source.Dedup)
+		}
+		if source.Spool != nil {
+			v.required(i, "source.spool.dir", source.Spool.Dir)
+			v.notNegative(i, "source.spool.maxSize", source.Spool.MaxSize)
+		}
+		if source.Ordering != nil {
+			v.ordering(i, source)
+		}
+		v.queueArguments(i, source.QueueArguments)
+		if source.DeadLetter != nil {
+			v.deadLetter(i, source)
+		}
+
+		destination := rule.Destination
+		v.oneOf(i, "destination.type", destination.Type, sns.Type, sqs.Type, lambda.Type)
+		v.required(i, "destination.name", destination.Name)
+		v.required(i, "destination.target", destination.Target)
+		if destination.Name == "" {
+			continue
+		}
+		if first, ok := names[destination.Name]; ok {
+			v.add(i, "destination.name", "duplicate name %q, already used by %s", destination.Name, v.label(first))
+			continue
+		}
+		names[destination.Name] = i
+	}
+	if len(v.problems) > 0 {
+		return ValidationError{v.problems}
+	}
+	return nil
+}
+
+func (v *validator) tls(index int, source config.RabbitEntry) {
+	for _, connectionURL := range source.URLs() {
+		if strings.HasPrefix(connectionURL, "amqp://") {
+			v.add(index, "source.tls", "requires amqps connection")
+			break
+		}
+	}
+	if (source.Tls.CertFile == "") != (source.Tls.KeyFile == "") {
+		v.add(index, "source.tls", "certFile and keyFile must be set together")
+	}
+	if source.Tls.AuthMechanism != "" {
+		v.oneOf(index, "source.tls.authMechanism", source.Tls.AuthMechanism, connector.PlainMechanism, connector.ExternalMechanism)
+	}
+	if source.Tls.MinVersion != "" {
+		var versions []string
+		for version := range connector.TlsVersions {
+			versions = append(versions, version)
+		}
+		sort.Strings(versions)
+		v.oneOf(index, "source.tls.minVersion", source.Tls.MinVersion, versions...)
+	}
+}
+
+func (v *validator) reconnect(index int, reconnect config.ReconnectEntry) {
+	v.notNegative(index, "source.reconnect.initialInterval", reconnect.InitialInterval)
+	v.notNegative(index, "source.reconnect.maxInterval", reconnect.MaxInterval)
+	v.notNegative(index, "source.reconnect.maxAttempts", reconnect.MaxAttempts)
+	if reconnect.Multiplier != 0 && reconnect.Multiplier < 1 {
+		v.add(index, "source.reconnect.multiplier", "must be at least 1")
+	}
+	if reconnect.InitialInterval > 0 && reconnect.MaxInterval > 0 && reconnect.InitialInterval > reconnect.MaxInterval {
+		v.add(index, "source.reconnect.maxInterval", "must not be lower than initialInterval")
+	}
+}
+
+func (v *validator) rateLimit(index int, rateLimit config.RateLimitEntry) {
+	if rateLimit.MessagesPerSecond <= 0 {
+		v.add(index, "source.rateLimit.messagesPerSecond", "must be greater than 0")
+	}
+	v.notNegative(index, "source.rateLimit.burst", rateLimit.Burst)
+}
+
+func (v *validator) circuitBreaker(index int, circuitBreaker config.CircuitBreakerEntry) {
+	if circuitBreaker.FailureRate < 0 || circuitBreaker.FailureRate > 100 {
+		v.add(index, "source.circuitBreaker.failureRate", "must be between 0 and 100 percent")
+	}
+	v.notNegative(index, "source.circuitBreaker.window", circuitBreaker.Window)
+	v.notNegative(index, "source.circuitBreaker.openInterval", circuitBreaker.OpenInterval)
+}
+
+func (v *validator) dedup(index int, dedupEntry config.DedupEntry) {
+	if dedupEntry.Header != "" && dedupEntry.Field != "" {
+		v.add(index, "source.dedup.field", "must not be set together with header")
+	}
+	v.notNegative(index, "source.dedup.ttl", dedupEntry.TTL)
+	if dedupEntry.Store != "" {
+		v.oneOf(index, "source.dedup.store", dedupEntry.Store, dedup.MemoryStore, dedup.DynamoDBStore)
+	}
+	if dedupEntry.Store == dedup.DynamoDBStore {
+		v.required(index, "source.dedup.table", dedupEntry.Table)
+	} else {
+		v.notNegative(index, "source.dedup.maxEntries", dedupEntry.MaxEntries)
+	}
+}
+
+func (v *validator) ordering(index int, source config.RabbitEntry) {
+	v.notNegative(index, "source.ordering.workers", source.Ordering.Workers)
+	if source.Ordering.Header != "" && source.Ordering.Field != "" {
+		v.add(index, "source.ordering.field", "must not be set together with header")
+	}
+	// a spooled message is forwarded after later messages of its key
+	if source.Spool != nil {
+		v.add(index, "source.ordering", "must not be set together with spool")
+	}
+}
+
+func (v *validator) queueArguments(index int, queueArguments map[string]interface{}) {
+	if value, ok := queueArguments[rabbitmq.QueueTypeArgument]; ok {
+		queueType, _ := value.(string)
+		v.oneOf(index, "source.queueArguments."+rabbitmq.QueueTypeArgument, queueType, rabbitmq.QueueTypeClassic, rabbitmq.QueueTypeQuorum, rabbitmq.QueueTypeStream)
+	}
+	for _, argument := range []string{rabbitmq.DeadLetterExchangeArgument, rabbitmq.DeadLetterRoutingKeyArgument} {
+		if _, ok := queueArguments[argument]; ok {
+			v.add(index, "source.queueArguments."+argument, "is set by the forwarder, use deadLetter settings")
+		}
+	}
+}
+
+func (v *validator) deadLetter(index int, source config.RabbitEntry) {
+	deadLetter := source.DeadLetter
+	if source.Passive {
+		v.add(index, "source.deadLetter", "is not used in passive mode")
+		return
+	}
+	if queueType, _ := source.QueueArguments[rabbitmq.QueueTypeArgument].(string); queueType == rabbitmq.QueueTypeStream {
+		v.add(index, "source.deadLetter", "is not supported by stream queues")
+		return
+	}
+	if deadLetter.Disabled {
+		if *deadLetter != (config.DeadLetterEntry{Disabled: true}) {
+			v.add(index, "source.deadLetter", "other settings are not used when disabled")
+		}
+		return
+	}
+	if deadLetter.ExchangeType != "" {
+		v.oneOf(index, "source.deadLetter.exchangeType", deadLetter.ExchangeType, exchangeTypes...)
+	}
+	v.notNegative(index, "source.deadLetter.messageTtl", deadLetter.MessageTTL)
+	v.notNegative(index, "source.deadLetter.maxLength", deadLetter.MaxLength)
+	if deadLetter.Queue != "" && deadLetter.Queue == source.QueueName {
+		v.add(index, "source.deadLetter.queue", "must differ from the queue")
+	}
+}
+
+// topology checks exchange, queue and bindings declared by the forwarder
+func (v *validator) topology(index int, source config.RabbitEntry) {
+	v.required(index, "source.topic", source.ExchangeName)
+	v.required(index, "source.queue", source.QueueName)
+	if source.ExchangeType != "" {
+		v.oneOf(index, "source.exchangeType", source.ExchangeType, exchangeTypes...)
+	}
+	// fanout and headers exchanges ignore the routing key, the queue is bound with an empty one
+	if source.RoutingKey == "" && len(source.RoutingKeys) == 0 && source.ExchangeType != "fanout" && source.ExchangeType != "headers" {
+		v.add(index, "source.routingKeys", "at least one routing key is required")
+	}
+	for j, routingKey := range source.RoutingKeys {
+		v.required(index, fmt.Sprintf("source.routingKeys[%d]", j), routingKey)
+	}
+}
+
+// passive reports topology settings which are not used when the queue is only verified
+func (v *validator) passive(index int, source config.RabbitEntry) {
+	v.required(index, "source.queue", source.QueueName)
+	if source.ExchangeName != "" || source.ExchangeType != "" || source.RoutingKey != "" || len(source.RoutingKeys) > 0 {
+		v.add(index, "source.passive", "topic, exchangeType and routing keys are not used in passive mode")
+	}
+	if len(source.ExchangeArguments) > 0 {
+		v.add(index, "source.passive", "exchangeArguments are not used in passive mode")
+	}
+}
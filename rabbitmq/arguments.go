@@ -0,0 +1,62 @@
+package rabbitmq
+
+import (
+	"math"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// QueueTypeArgument queue type declaration argument
+	QueueTypeArgument = "x-queue-type"
+	// DeadLetterExchangeArgument dead-letter exchange declaration argument, set by the forwarder
+	DeadLetterExchangeArgument = "x-dead-letter-exchange"
+	// QueueTypeClassic classic queue
+	QueueTypeClassic = "classic"
+	// QueueTypeQuorum replicated quorum queue
+	QueueTypeQuorum = "quorum"
+	// QueueTypeStream append-only stream, consumed with prefetch and without dead-lettering
+	QueueTypeStream = "stream"
+	// streamPrefetch unacknowledged messages per stream consumer
+	streamPrefetch = 100
+)
+
+// arguments converts mapping values to declaration arguments, whole JSON numbers
+// become integers because the broker rejects floats e.g. for x-max-length
+func arguments(values map[string]interface{}) amqp.Table {
+	if len(values) == 0 {
+		return nil
+	}
+	table := make(amqp.Table, len(values))
+	for key, value := range values {
+		table[key] = argument(value)
+	}
+	return table
+}
+
+func argument(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < math.MaxInt64 {
+			return int64(v)
+		}
+		return v
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = argument(item)
+		}
+		return list
+	case map[string]interface{}:
+		return arguments(v)
+	}
+	return value
+}
+
+// queueType declared queue type, classic when not set
+func queueType(table amqp.Table) string {
+	if queueType, ok := table[QueueTypeArgument].(string); ok {
+		return queueType
+	}
+	return QueueTypeClassic
+}
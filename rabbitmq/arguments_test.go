@@ -0,0 +1,38 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestArguments(t *testing.T) {
+	var values map[string]interface{}
+	mapping := `{"x-queue-type":"quorum","x-max-length":1000,"x-message-ttl":60000,"x-single-active-consumer":true,"x-ratio":0.5,"x-list":[1,"a"]}`
+	if err := json.Unmarshal([]byte(mapping), &values); err != nil {
+		t.Fatal(err)
+	}
+	expected := amqp.Table{
+		"x-queue-type":             "quorum",
+		"x-max-length":             int64(1000),
+		"x-message-ttl":            int64(60000),
+		"x-single-active-consumer": true,
+		"x-ratio":                  0.5,
+		"x-list":                   []interface{}{int64(1), "a"},
+	}
+	table := arguments(values)
+	if !reflect.DeepEqual(table, expected) {
+		t.Errorf("wrong arguments, expected:%v, got:%v", expected, table)
+	}
+	if err := table.Validate(); err != nil {
+		t.Errorf("arguments not accepted by amqp: %s", err.Error())
+	}
+	if queueType(table) != QueueTypeQuorum || queueType(nil) != QueueTypeClassic {
+		t.Error("wrong queue type")
+	}
+	if arguments(nil) != nil {
+		t.Error("empty arguments should be nil")
+	}
+}
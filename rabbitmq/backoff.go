@@ -0,0 +1,69 @@
+package rabbitmq
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+)
+
+const (
+	// DefaultReconnectInitialInterval seconds before the first reconnect
+	DefaultReconnectInitialInterval = 1
+	// DefaultReconnectMaxInterval maximal seconds between reconnects
+	DefaultReconnectMaxInterval = 60
+	// DefaultReconnectMultiplier interval growth after every failed attempt
+	DefaultReconnectMultiplier = 2
+)
+
+// backoff exponential reconnect backoff with jitter, so instances restarted
+// together do not reconnect in lockstep
+type backoff struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	multiplier      float64
+	maxAttempts     int
+	attempts        int
+}
+
+func newBackoff(entry config.ReconnectEntry) *backoff {
+	b := &backoff{
+		initialInterval: DefaultReconnectInitialInterval * time.Second,
+		maxInterval:     DefaultReconnectMaxInterval * time.Second,
+		multiplier:      DefaultReconnectMultiplier,
+		maxAttempts:     entry.MaxAttempts,
+	}
+	if entry.InitialInterval > 0 {
+		b.initialInterval = time.Duration(entry.InitialInterval) * time.Second
+	}
+	if entry.MaxInterval > 0 {
+		b.maxInterval = time.Duration(entry.MaxInterval) * time.Second
+	}
+	if entry.Multiplier >= 1 {
+		b.multiplier = entry.Multiplier
+	}
+	return b
+}
+
+// next records failed attempt and returns the wait before the next one,
+// false when max attempts are exhausted
+func (b *backoff) next() (time.Duration, bool) {
+	b.attempts++
+	if b.maxAttempts > 0 && b.attempts >= b.maxAttempts {
+		return 0, false
+	}
+	interval := float64(b.initialInterval)
+	for i := 1; i < b.attempts && interval < float64(b.maxInterval); i++ {
+		interval *= b.multiplier
+	}
+	if interval > float64(b.maxInterval) {
+		interval = float64(b.maxInterval)
+	}
+	half := time.Duration(interval / 2)
+	return half + time.Duration(rand.Int63n(int64(half)+1)), true
+}
+
+// reset starts from the initial interval after a successful connection
+func (b *backoff) reset() {
+	b.attempts = 0
+}
@@ -0,0 +1,50 @@
+package rabbitmq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(config.ReconnectEntry{InitialInterval: 2, MaxInterval: 10})
+	intervals := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, interval := range intervals {
+		wait, ok := b.next()
+		if !ok {
+			t.Fatalf("attempt %d: unexpected give up", i+1)
+		}
+		if wait < interval/2 || wait > interval {
+			t.Errorf("attempt %d: wait %s out of range %s - %s", i+1, wait, interval/2, interval)
+		}
+	}
+	b.reset()
+	if wait, _ := b.next(); wait > 2*time.Second {
+		t.Errorf("wait not reset, got %s", wait)
+	}
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	b := newBackoff(config.ReconnectEntry{})
+	if b.initialInterval != time.Second || b.maxInterval != time.Minute || b.multiplier != 2 || b.maxAttempts != 0 {
+		t.Errorf("wrong defaults, got %+v", b)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := b.next(); !ok {
+			t.Fatal("unlimited attempts should not give up")
+		}
+	}
+}
+
+func TestBackoffMaxAttempts(t *testing.T) {
+	b := newBackoff(config.ReconnectEntry{MaxAttempts: 3})
+	for i := 1; i < 3; i++ {
+		if _, ok := b.next(); !ok {
+			t.Fatalf("attempt %d: unexpected give up", i)
+		}
+	}
+	if _, ok := b.next(); ok {
+		t.Error("should give up after max attempts")
+	}
+}
@@ -0,0 +1,139 @@
+package rabbitmq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+)
+
+const (
+	// BreakerClosed messages are forwarded
+	BreakerClosed = "closed"
+	// BreakerOpen destination keeps failing, the consumer is cancelled
+	BreakerOpen = "open"
+	// BreakerHalfOpen consuming resumed, the next message probes the destination
+	BreakerHalfOpen = "half-open"
+	// DefaultBreakerFailureRate failed messages in percent which open the breaker
+	DefaultBreakerFailureRate = 50
+	// DefaultBreakerWindow number of last messages the failure rate is computed from
+	DefaultBreakerWindow = 20
+	// DefaultBreakerOpenInterval seconds before probing the destination
+	DefaultBreakerOpenInterval = 30
+)
+
+// circuitBreaker failure rate of the last messages, shared by consumer copies
+type circuitBreaker struct {
+	mutex        sync.Mutex
+	failureRate  float64
+	openInterval time.Duration
+	outcomes     []bool
+	next         int
+	recorded     int
+	failures     int
+	state        string
+	openedAt     time.Time
+	now          func() time.Time
+}
+
+// newCircuitBreaker nil when the breaker is not configured
+func newCircuitBreaker(entry *config.CircuitBreakerEntry) *circuitBreaker {
+	if entry == nil {
+		return nil
+	}
+	b := &circuitBreaker{
+		failureRate:  DefaultBreakerFailureRate,
+		openInterval: DefaultBreakerOpenInterval * time.Second,
+		outcomes:     make([]bool, DefaultBreakerWindow),
+		state:        BreakerClosed,
+		now:          time.Now,
+	}
+	if entry.FailureRate > 0 {
+		b.failureRate = entry.FailureRate
+	}
+	if entry.OpenInterval > 0 {
+		b.openInterval = time.Duration(entry.OpenInterval) * time.Second
+	}
+	if entry.Window > 0 {
+		b.outcomes = make([]bool, entry.Window)
+	}
+	return b
+}
+
+// get breaker state, empty when not configured
+func (b *circuitBreaker) get() string {
+	if b == nil {
+		return ""
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+// record adds the outcome of a forwarded message, true when the breaker opened
+func (b *circuitBreaker) record(failed bool) bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.open()
+			return true
+		}
+		b.state = BreakerClosed
+		return false
+	case BreakerOpen:
+		// messages delivered before the consumer was cancelled
+		return false
+	}
+	if b.outcomes[b.next] {
+		b.failures--
+	}
+	b.outcomes[b.next] = failed
+	if failed {
+		b.failures++
+	}
+	b.next = (b.next + 1) % len(b.outcomes)
+	if b.recorded < len(b.outcomes) {
+		b.recorded++
+	}
+	// the rate is computed once the window is full
+	if b.recorded == len(b.outcomes) && float64(b.failures)*100 >= b.failureRate*float64(b.recorded) {
+		b.open()
+		return true
+	}
+	return false
+}
+
+func (b *circuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = b.now()
+	for i := range b.outcomes {
+		b.outcomes[i] = false
+	}
+	b.next, b.recorded, b.failures = 0, 0, 0
+}
+
+// isOpen whether consuming should stay cancelled
+func (b *circuitBreaker) isOpen() bool {
+	return b.get() == BreakerOpen
+}
+
+// probeIn wait before the open breaker lets a trial message through
+func (b *circuitBreaker) probeIn() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.openedAt.Add(b.openInterval).Sub(b.now())
+}
+
+// halfOpen lets the next message probe the destination
+func (b *circuitBreaker) halfOpen() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == BreakerOpen {
+		b.state = BreakerHalfOpen
+	}
+}
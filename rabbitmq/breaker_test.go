@@ -0,0 +1,71 @@
+package rabbitmq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+)
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	breaker := newCircuitBreaker(&config.CircuitBreakerEntry{FailureRate: 50, Window: 4})
+	outcomes := []struct {
+		failed bool
+		opened bool
+	}{
+		{true, false},
+		{true, false},
+		{false, false},
+		// window full with 3 of 4 failed
+		{true, true},
+	}
+	for i, outcome := range outcomes {
+		if opened := breaker.record(outcome.failed); opened != outcome.opened {
+			t.Errorf("message %d: wrong opened, expected:%t, got:%t", i, outcome.opened, opened)
+		}
+	}
+	if state := breaker.get(); state != BreakerOpen {
+		t.Errorf("wrong state, expected:%s, got:%s", BreakerOpen, state)
+	}
+}
+
+func TestCircuitBreakerSlidingWindow(t *testing.T) {
+	breaker := newCircuitBreaker(&config.CircuitBreakerEntry{FailureRate: 75, Window: 4})
+	// failures spread out never reach 3 of the last 4 messages
+	for i, failed := range []bool{true, true, false, false, true, false, true, false, true} {
+		if breaker.record(failed) {
+			t.Fatalf("message %d: breaker should stay closed", i)
+		}
+	}
+	if !breaker.record(true) {
+		t.Error("breaker should open with 3 of the last 4 messages failed")
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	breaker := newCircuitBreaker(&config.CircuitBreakerEntry{Window: 1, OpenInterval: 10})
+	breaker.now = func() time.Time { return now }
+	if !breaker.record(true) || !breaker.isOpen() {
+		t.Fatal("breaker should open")
+	}
+	now = now.Add(4 * time.Second)
+	if probeIn := breaker.probeIn(); probeIn != 6*time.Second {
+		t.Errorf("wrong probe wait, expected:%v, got:%v", 6*time.Second, probeIn)
+	}
+	breaker.halfOpen()
+	if !breaker.record(true) || !breaker.isOpen() {
+		t.Error("failed probe should open the breaker again")
+	}
+	breaker.halfOpen()
+	if breaker.record(false) || breaker.get() != BreakerClosed {
+		t.Errorf("successful probe should close the breaker, got:%s", breaker.get())
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	breaker := newCircuitBreaker(nil)
+	if breaker.record(true) || breaker.isOpen() || breaker.get() != "" {
+		t.Error("missing breaker should never open")
+	}
+}
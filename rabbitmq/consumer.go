@@ -3,6 +3,7 @@ package rabbitmq
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -10,7 +11,11 @@ import (
 	"github.com/phorest/rabbit-amazon-forwarder/config"
 	"github.com/phorest/rabbit-amazon-forwarder/connector"
 	"github.com/phorest/rabbit-amazon-forwarder/consumer"
+	"github.com/phorest/rabbit-amazon-forwarder/dedup"
 	"github.com/phorest/rabbit-amazon-forwarder/forwarder"
+	"github.com/phorest/rabbit-amazon-forwarder/redact"
+	"github.com/phorest/rabbit-amazon-forwarder/secrets"
+	"github.com/phorest/rabbit-amazon-forwarder/spool"
 	"github.com/streadway/amqp"
 )
 
@@ -19,29 +24,60 @@ const (
 	Type                      = "RabbitMQ"
 	channelClosedMessage      = "Channel closed"
 	closedBySupervisorMessage = "Closed by supervisor"
-	// ReconnectRabbitMQInterval time to reconnect
-	ReconnectRabbitMQInterval = 10
+	// FailoverOrdered tries the nodes in the configured order on every reconnect
+	FailoverOrdered = "ordered"
+	// FailoverRandom tries the nodes in random order on every reconnect
+	FailoverRandom = "random"
 )
 
 // Consumer implementation or RabbitMQ consumer
 type Consumer struct {
 	name            string
-	ConnectionURL   string
+	ConnectionURLs  []string
+	Failover        string
 	ExchangeName    string
 	ExchangeType    string
 	QueueName       string
 	RoutingKeys     []string
 	RabbitConnector connector.RabbitConnector
+	SecretResolver  secrets.Resolver
+	Reconnect       config.ReconnectEntry
+	QueueArgs       amqp.Table
+	ExchangeArgs    amqp.Table
+	Passive         bool
+	DeadLetter      config.DeadLetterEntry
+	RateLimit       config.RateLimitEntry
+	Dedup           *dedup.Client
+	Spool           *spool.Spool
+	Ordering        config.OrderingEntry
+	status          *connectionStatus
+	breaker         *circuitBreaker
 }
 
 // parameters for starting consumer
 type workerParams struct {
 	forwarder forwarder.Client
 	msgs      <-chan amqp.Delivery
+	closed    chan *amqp.Error
+	cancelled chan string
+	confirms  chan amqp.Confirmation
+	limiter   *rateLimiter
 	check     chan bool
 	stop      chan bool
+	pause     chan bool
+	paused    bool
 	conn      *amqp.Connection
 	ch        *amqp.Channel
+	// tripped consumer cancelled by the open circuit breaker, probe fires when it may half-open
+	tripped bool
+	probe   <-chan time.Time
+	// drain fires when the next spooled message may be forwarded
+	drain         <-chan time.Time
+	drainReserved bool
+	drainBackoff  *backoff
+	spoolFull     bool
+	// partitions workers forwarding in order per key, nil when forwarding one message at a time
+	partitions *partitions
 }
 
 // CreateConsumer creates consumer from string map
@@ -56,7 +92,19 @@ func CreateConsumer(entry config.RabbitEntry, rabbitConnector connector.RabbitCo
 	} else {
 		exchangeType = "topic"
 	}
-	return Consumer{entry.Name, entry.ConnectionURL, entry.ExchangeName, exchangeType, entry.QueueName, entry.RoutingKeys, rabbitConnector}
+	failover := entry.Failover
+	if failover == "" {
+		failover = FailoverOrdered
+	}
+	var reconnect config.ReconnectEntry
+	if entry.Reconnect != nil {
+		reconnect = *entry.Reconnect
+	}
+	var rateLimit config.RateLimitEntry
+	if entry.RateLimit != nil {
+		rateLimit = *entry.RateLimit
+	}
+	return Consumer{entry.Name, entry.URLs(), failover, entry.ExchangeName, exchangeType, entry.QueueName, entry.RoutingKeys, rabbitConnector, secrets.Default, reconnect, arguments(entry.QueueArguments), arguments(entry.ExchangeArguments), entry.Passive, deadLetter(entry.DeadLetter, entry.QueueName), rateLimit, dedup.New(entry.Dedup), newSpool(entry.Spool), newOrdering(entry.Ordering), newConnectionStatus(rabbitConnector), newCircuitBreaker(entry.CircuitBreaker)}
 }
 
 // Name consumer name
@@ -64,95 +112,388 @@ func (c Consumer) Name() string {
 	return c.name
 }
 
+// Node currently connected broker node with the password masked
+func (c Consumer) Node() string {
+	if c.status == nil {
+		return ""
+	}
+	return c.status.node()
+}
+
+// State connection state with the reason reported by the broker
+func (c Consumer) State() string {
+	if c.status == nil {
+		return ""
+	}
+	return c.status.get()
+}
+
+// Breaker circuit breaker state, empty when not configured
+func (c Consumer) Breaker() string {
+	return c.breaker.get()
+}
+
 // Start start consuming messages from Rabbit queue
-func (c Consumer) Start(forwarder forwarder.Client, check chan bool, stop chan bool) error {
+func (c Consumer) Start(forwarder forwarder.Client, check chan bool, stop chan bool, pause chan bool) error {
 	log.WithFields(log.Fields{
 		"exchangeName": c.ExchangeName,
 		"queueName":    c.QueueName}).Info("Starting connecting consumer")
+	paused := false
+	reconnect := newBackoff(c.Reconnect)
+	// the bucket is kept across reconnects
+	limiter := newRateLimiter(c.RateLimit)
+	drainBackoff := newBackoff(config.ReconnectEntry{})
+	if err := c.openSpool(forwarder.Name()); err != nil {
+		log.WithFields(log.Fields{
+			"consumerName": c.Name(),
+			"error":        err.Error()}).Error("Could not open spool")
+		return fmt.Errorf("could not open spool: %s", err)
+	}
+	defer c.closeSpool()
 	for {
-		delivery, conn, ch, err := c.initRabbitMQ()
+		// a paused consumer or one waiting for the probe is registered when it resumes
+		tripped := c.breaker.isOpen()
+		delivery, conn, ch, err := c.initRabbitMQ(!paused && !tripped)
 		if err != nil {
 			log.Error(err)
-			closeRabbitMQ(conn, ch)
-			time.Sleep(ReconnectRabbitMQInterval * time.Second)
+			c.closeRabbitMQ(conn, ch)
+			if retry, err := c.retry(reconnect, err, check, stop, pause, &paused); !retry {
+				return err
+			}
 			continue
 		}
-		params := workerParams{forwarder, delivery, check, stop, conn, ch}
-		if err := c.startForwarding(&params); err.Error() == closedBySupervisorMessage {
+		params := workerParams{forwarder: forwarder, msgs: delivery, check: check, stop: stop, pause: pause, paused: paused, conn: conn, ch: ch, limiter: limiter, drainBackoff: drainBackoff,
+			closed:    ch.NotifyClose(make(chan *amqp.Error, 1)),
+			cancelled: ch.NotifyCancel(make(chan string, 1))}
+		if c.annotatesDeadLetters() {
+			if params.confirms, err = c.confirmPublishing(ch); err != nil {
+				log.Error(err)
+				c.closeRabbitMQ(conn, ch)
+				if retry, err := c.retry(reconnect, err, check, stop, pause, &paused); !retry {
+					return err
+				}
+				continue
+			}
+		}
+		reconnect.reset()
+		// keep waiting for the probe when the breaker opened before reconnecting
+		if tripped {
+			params.tripped = true
+			params.probe = time.After(c.breaker.probeIn())
+		}
+		c.resumeDrain(&params)
+		params.partitions = c.startPartitions(forwarder, c.prefetch(queueType(c.QueueArgs)))
+		c.status.set(StateConnected, "")
+		err = c.startForwarding(&params)
+		params.partitions.stop()
+		paused = params.paused
+		if err.Error() == closedBySupervisorMessage {
 			break
 		}
 	}
 	return nil
 }
 
-func closeRabbitMQ(conn *amqp.Connection, ch *amqp.Channel) {
+// handleResult acks the forwarded message, otherwise spools, dead-letters or rejects it
+func (c Consumer) handleResult(params *workerParams, d amqp.Delivery, dedupKey string, err error) error {
+	forwarderName := params.forwarder.Name()
+	if c.breaker.record(err != nil) {
+		if tripErr := c.trip(params); tripErr != nil {
+			log.WithFields(log.Fields{
+				"forwarderName": forwarderName,
+				"error":         tripErr.Error()}).Error("Could not cancel consumer")
+			c.closeRabbitMQ(params.conn, params.ch)
+			return tripErr
+		}
+	}
+	if err != nil && forwarder.Retryable(err) {
+		if spooled, err := c.spoolDelivery(params, d, dedupKey); spooled {
+			return err
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"forwarderName": forwarderName,
+			"error":         err.Error()}).Error("Could not forward message")
+		var publishErr error
+		if params.confirms != nil {
+			if publishErr = c.publishDeadLetter(params, d, err); publishErr == nil {
+				if err = d.Ack(false); err != nil {
+					log.WithFields(log.Fields{
+						"forwarderName": forwarderName,
+						"error":         err.Error(),
+						"messageID":     d.MessageId}).Error("Could not ack dead-lettered message")
+					return err
+				}
+				return nil
+			}
+			if publishErr.Error() == closedBySupervisorMessage {
+				// the message stays unacked and is redelivered
+				log.WithField("forwarderName", forwarderName).Info("Closing")
+				c.closeRabbitMQ(params.conn, params.ch)
+				return publishErr
+			}
+			log.WithFields(log.Fields{
+				"forwarderName": forwarderName,
+				"error":         publishErr.Error()}).Error("Could not dead-letter message with error details, rejecting")
+		}
+		if err = d.Reject(false); err != nil {
+			log.WithFields(log.Fields{
+				"forwarderName": forwarderName,
+				"error":         err.Error()}).Error("Could not reject message")
+			return err
+		}
+		if publishErr == errConfirmTimeout {
+			// a late confirmation would be taken for the next copy, the channel is opened again
+			c.closeRabbitMQ(params.conn, params.ch)
+			return publishErr
+		}
+		return nil
+	}
+	c.recordForwarded(forwarderName, dedupKey)
+	// only this delivery, partition workers complete out of delivery order
+	if err := d.Ack(false); err != nil {
+		log.WithFields(log.Fields{
+			"forwarderName": forwarderName,
+			"error":         err.Error(),
+			"messageID":     d.MessageId}).Error("Could not ack message")
+		return err
+	}
+	return nil
+}
+
+// throttle waits until the rate limit allows forwarding the next message while still answering
+// the supervisor, unacknowledged messages are limited by the prefetch so the backlog stays in the queue
+func (c Consumer) throttle(params *workerParams) error {
+	wait := params.limiter.reserve()
+	if wait <= 0 {
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"consumerName": c.Name(),
+		"wait":         wait.String()}).Debug("Rate limit reached, waiting")
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return nil
+		case <-params.check:
+			log.WithField("consumerName", c.Name()).Info("Checking")
+		case pause := <-params.pause:
+			if err := c.setPaused(params, pause); err != nil {
+				log.WithFields(log.Fields{
+					"consumerName": c.Name(),
+					"error":        err.Error()}).Error("Could not change consumer state")
+				c.closeRabbitMQ(params.conn, params.ch)
+				return err
+			}
+		case <-params.stop:
+			log.WithField("consumerName", c.Name()).Info("Closing")
+			c.closeRabbitMQ(params.conn, params.ch)
+			return errors.New(closedBySupervisorMessage)
+		}
+	}
+}
+
+// retry waits before the next reconnect attempt, false when stopped or when giving up with the error
+func (c Consumer) retry(reconnect *backoff, err error, check chan bool, stop chan bool, pause chan bool, paused *bool) (bool, error) {
+	c.status.set(StateConnecting, err.Error())
+	wait, ok := reconnect.next()
+	if !ok {
+		log.WithFields(log.Fields{
+			"consumerName": c.Name(),
+			"attempts":     reconnect.attempts}).Error("Giving up reconnecting")
+		return false, fmt.Errorf("gave up reconnecting after %d attempts: %s", reconnect.attempts, err)
+	}
+	log.WithFields(log.Fields{
+		"consumerName": c.Name(),
+		"attempt":      reconnect.attempts,
+		"wait":         wait.String()}).Info("Waiting to reconnect")
+	return c.waitToReconnect(wait, check, stop, pause, paused), nil
+}
+
+// waitToReconnect waits while still answering the supervisor, false when stopped
+func (c Consumer) waitToReconnect(wait time.Duration, check chan bool, stop chan bool, pause chan bool, paused *bool) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-check:
+			log.WithField("consumerName", c.Name()).Info("Checking")
+		case *paused = <-pause:
+			log.WithFields(log.Fields{
+				"consumerName": c.Name(),
+				"paused":       *paused}).Info("Changed state while reconnecting")
+		case <-stop:
+			log.WithField("consumerName", c.Name()).Info("Closing")
+			return false
+		}
+	}
+}
+
+// closeRabbitMQ closes the channel and releases the connection, which may be shared with other consumers
+func (c Consumer) closeRabbitMQ(conn *amqp.Connection, ch *amqp.Channel) {
 	log.Info("Closing RabbitMQ connection and channel")
+	c.status.disconnected()
 	if ch != nil {
 		if err := ch.Close(); err != nil {
 			log.WithField("error", err.Error()).Error("Could not close channel")
 		}
 	}
 	if conn != nil {
-		if err := conn.Close(); err != nil {
+		if err := c.RabbitConnector.ReleaseConnection(conn); err != nil {
 			log.WithField("error", err.Error()).Error("Could not close connection")
 		}
 	}
 }
 
-func (c Consumer) initRabbitMQ() (<-chan amqp.Delivery, *amqp.Connection, *amqp.Channel, error) {
+// initRabbitMQ connects and declares the queue, the consumer is registered unless it starts paused
+func (c Consumer) initRabbitMQ(consuming bool) (<-chan amqp.Delivery, *amqp.Connection, *amqp.Channel, error) {
 	_, connection, channel, err := c.connect()
 	if err != nil {
 		return nil, connection, channel, err
 	}
-	delivery, _, _, err := c.setupExchangesAndQueues(connection, channel)
+	if _, _, _, err = c.setupExchangesAndQueues(connection, channel); err != nil || !consuming {
+		return nil, connection, channel, err
+	}
+	delivery, _, _, err := c.consume(channel)
 	return delivery, connection, channel, err
 }
 
 func (c Consumer) connect() (<-chan amqp.Delivery, *amqp.Connection, *amqp.Channel, error) {
-	conn, err := c.RabbitConnector.CreateConnection(c.ConnectionURL)
+	conn, connectionURL, err := c.dialNodes()
 	if err != nil {
-		return failOnError(err, "Failed to connect to RabbitMQ")
+		return nil, nil, nil, err
 	}
+	c.status.connected(conn, connectionURL)
 	ch, err := conn.Channel()
 	if err != nil {
-		return failOnError(err, "Failed to open a channel")
+		_, _, _, err = failOnError(err, "Failed to open a channel")
+		return nil, conn, nil, err
 	}
 	return nil, conn, ch, nil
 }
 
+// dialNodes connects to the first reachable node, the order is decided on every reconnect
+func (c Consumer) dialNodes() (*amqp.Connection, string, error) {
+	var err error
+	for _, nodeURL := range c.nodeOrder() {
+		var connectionURL string
+		// resolved on every connect so rotated credentials are picked up
+		if connectionURL, err = c.SecretResolver.Resolve(nodeURL); err != nil {
+			_, _, _, err = failOnError(err, "Failed to resolve connection url")
+			log.WithFields(log.Fields{
+				"consumerName": c.Name(),
+				"error":        err.Error()}).Warn("Could not connect to node, trying next one")
+			continue
+		}
+		var conn *amqp.Connection
+		if conn, err = c.RabbitConnector.CreateConnection(connectionURL); err != nil {
+			_, _, _, err = failOnError(err, "Failed to connect to RabbitMQ")
+			log.WithFields(log.Fields{
+				"consumerName": c.Name(),
+				"node":         redact.URL(connectionURL),
+				"error":        err.Error()}).Warn("Could not connect to node, trying next one")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"consumerName": c.Name(),
+			"node":         redact.URL(connectionURL)}).Info("Connected to node")
+		return conn, connectionURL, nil
+	}
+	if err == nil {
+		err = errors.New("no connection url configured")
+	}
+	return nil, "", err
+}
+
+// nodeOrder node urls in the order to try them
+func (c Consumer) nodeOrder() []string {
+	nodes := append([]string(nil), c.ConnectionURLs...)
+	if c.Failover == FailoverRandom {
+		rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	}
+	return nodes
+}
+
 func (c Consumer) setupExchangesAndQueues(conn *amqp.Connection, ch *amqp.Channel) (<-chan amqp.Delivery, *amqp.Connection, *amqp.Channel, error) {
+	if c.Passive {
+		return c.verifyQueue(ch)
+	}
 	var err error
-	deadLetterExchangeName := c.QueueName + "-dead-letter"
-	deadLetterQueueName := c.QueueName + "-dead-letter"
 	// regular exchange
-	if err = ch.ExchangeDeclare(c.ExchangeName, c.ExchangeType, true, false, false, false, nil); err != nil {
+	if err = ch.ExchangeDeclare(c.ExchangeName, c.ExchangeType, true, false, false, false, c.ExchangeArgs); err != nil {
 		return failOnError(err, "Failed to declare an exchange:"+c.ExchangeName)
 	}
-	// dead-letter-exchange
-	if err = ch.ExchangeDeclare(deadLetterExchangeName, "fanout", true, false, false, false, nil); err != nil {
-		return failOnError(err, "Failed to declare an exchange:"+deadLetterExchangeName)
+	queueArgs := amqp.Table{}
+	for key, value := range c.QueueArgs {
+		queueArgs[key] = value
 	}
-	// dead-letter-queue
-	if _, err = ch.QueueDeclare(deadLetterQueueName, true, false, false, false, nil); err != nil {
-		return failOnError(err, "Failed to declare a queue:"+deadLetterQueueName)
-	}
-	if err = ch.QueueBind(deadLetterQueueName, "#", deadLetterExchangeName, false, nil); err != nil {
-		return failOnError(err, "Failed to bind a queue:"+deadLetterQueueName)
+	// streams do not support dead-lettering
+	if queueType(queueArgs) != QueueTypeStream {
+		if err = c.declareDeadLetter(ch, queueArgs); err != nil {
+			return nil, nil, nil, err
+		}
 	}
 	// regular queue
-	if _, err = ch.QueueDeclare(c.QueueName, true, false, false, false,
-		amqp.Table{
-			"x-dead-letter-exchange": deadLetterExchangeName,
-		}); err != nil {
+	if _, err = ch.QueueDeclare(c.QueueName, true, false, false, false, queueArgs); err != nil {
 		return failOnError(err, "Failed to declare a queue:"+c.QueueName)
 	}
-	// bind all of the routing keys
-	for _, routingKey := range c.RoutingKeys {
+	if err = c.setPrefetch(ch, queueType(queueArgs)); err != nil {
+		return failOnError(err, "Failed to set prefetch:"+c.QueueName)
+	}
+	// bind all of the routing keys, fanout and headers exchanges are bound without one
+	routingKeys := c.RoutingKeys
+	if len(routingKeys) == 0 {
+		routingKeys = []string{""}
+	}
+	for _, routingKey := range routingKeys {
 		if err = ch.QueueBind(c.QueueName, routingKey, c.ExchangeName, false, nil); err != nil {
 			return failOnError(err, "Failed to bind a queue:"+c.QueueName)
 		}
 	}
 
+	return nil, nil, nil, nil
+}
+
+// verifyQueue checks the queue exists without declaring exchanges, bindings and dead-letter queue
+func (c Consumer) verifyQueue(ch *amqp.Channel) (<-chan amqp.Delivery, *amqp.Connection, *amqp.Channel, error) {
+	if _, err := ch.QueueDeclarePassive(c.QueueName, true, false, false, false, nil); err != nil {
+		return failOnError(err, "Queue does not exist:"+c.QueueName)
+	}
+	if err := c.setPrefetch(ch, queueType(c.QueueArgs)); err != nil {
+		return failOnError(err, "Failed to set prefetch:"+c.QueueName)
+	}
+	return nil, nil, nil, nil
+}
+
+// setPrefetch limits unacknowledged messages of stream, rate limited and ordered consumers
+func (c Consumer) setPrefetch(ch *amqp.Channel, queueType string) error {
+	prefetch := c.prefetch(queueType)
+	if prefetch == 0 {
+		return nil
+	}
+	return ch.Qos(prefetch, 0, false)
+}
+
+// prefetch unacknowledged messages delivered to the consumer, 0 is unlimited. Streams require
+// a prefetch, rate limited consumers leave the backlog in the queue instead of buffering it
+func (c Consumer) prefetch(queueType string) int {
+	switch {
+	case c.RateLimit.MessagesPerSecond > 0:
+		return rateLimitBurst(c.RateLimit)
+	case c.Ordering.Workers > 0:
+		return c.Ordering.Workers * orderingPrefetch
+	case queueType == QueueTypeStream:
+		return streamPrefetch
+	}
+	return 0
+}
+
+func (c Consumer) consume(ch *amqp.Channel) (<-chan amqp.Delivery, *amqp.Connection, *amqp.Channel, error) {
 	msgs, err := ch.Consume(c.QueueName, c.Name(), false, false, false, false, nil)
 	if err != nil {
 		return failOnError(err, "Failed to register a consumer")
@@ -169,44 +510,208 @@ func (c Consumer) startForwarding(params *workerParams) error {
 		select {
 		case d, ok := <-params.msgs:
 			if !ok { // channel already closed
-				closeRabbitMQ(params.conn, params.ch)
+				if !params.consuming() {
+					// consumer cancelled and all inflight messages handled
+					params.msgs = nil
+					continue
+				}
+				c.reportClosed(params, nil, "")
+				c.closeRabbitMQ(params.conn, params.ch)
 				return errors.New(channelClosedMessage)
 			}
+			if !params.consuming() {
+				// delivered before the consumer was cancelled, stays in the queue
+				if err := d.Nack(false, true); err != nil {
+					log.WithFields(log.Fields{
+						"forwarderName": forwarderName,
+						"error":         err.Error(),
+						"messageID":     d.MessageId}).Error("Could not requeue message")
+					return err
+				}
+				continue
+			}
 			log.WithFields(log.Fields{
 				"consumerName": c.Name(),
 				"messageID":    d.MessageId}).Info("Message to forward")
+			if log.GetLevel() >= log.DebugLevel {
+				log.WithFields(log.Fields{
+					"consumerName": c.Name(),
+					"messageID":    d.MessageId,
+					"headers":      redact.Headers(d.Headers),
+					"body":         redact.Body(d.Body)}).Debug("Message body")
+			}
 
-			err := params.forwarder.Push(string(d.Body), d.Headers) 
-			if err != nil {
+			dedupKey := c.Dedup.Key(d.MessageId, d.Headers, d.Body)
+			if c.forwarded(forwarderName, dedupKey) {
 				log.WithFields(log.Fields{
 					"forwarderName": forwarderName,
-					"error":         err.Error()}).Error("Could not forward message")
-				if err = d.Reject(false); err != nil {
+					"messageID":     d.MessageId,
+					"dedupKey":      dedupKey}).Info("Skipping already forwarded message")
+				if err := d.Ack(false); err != nil {
 					log.WithFields(log.Fields{
 						"forwarderName": forwarderName,
-						"error":         err.Error()}).Error("Could not reject message")
+						"error":         err.Error(),
+						"messageID":     d.MessageId}).Error("Could not ack message")
 					return err
 				}
-
-			} else {
-				if err := d.Ack(true); err != nil {
+				continue
+			}
+			if c.Spool.Pending() > 0 {
+				// keeps the order, the message is forwarded when the spool drains
+				if spooled, err := c.spoolDelivery(params, d, dedupKey); spooled {
+					if err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			if err := c.throttle(params); err != nil {
+				return err
+			}
+			if params.partitions != nil {
+				params.partitions.dispatch(c.partitionKey(d), forwardJob{d, dedupKey})
+				continue
+			}
+			err := params.forwarder.Push(string(d.Body), d.Headers)
+			if err = c.handleResult(params, d, dedupKey, err); err != nil {
+				return err
+			}
+		case result := <-params.results():
+			if result.requeue {
+				if err := result.delivery.Nack(false, true); err != nil {
 					log.WithFields(log.Fields{
 						"forwarderName": forwarderName,
 						"error":         err.Error(),
-						"messageID":     d.MessageId}).Error("Could not ack message")
+						"messageID":     result.delivery.MessageId}).Error("Could not requeue message")
 					return err
 				}
+				continue
+			}
+			if err := c.handleResult(params, result.delivery, result.dedupKey, result.err); err != nil {
+				return err
+			}
+		case closeErr := <-params.closed:
+			c.reportClosed(params, closeErr, "")
+			c.closeRabbitMQ(params.conn, params.ch)
+			return errors.New(channelClosedMessage)
+		case tag := <-params.cancelled:
+			// deliveries stop, reconnecting declares the queue again unless passive
+			c.reportClosed(params, nil, tag)
+			c.closeRabbitMQ(params.conn, params.ch)
+			return errors.New(channelClosedMessage)
+		case <-params.drain:
+			if err := c.drainSpool(params, forwarderName); err != nil {
+				log.WithFields(log.Fields{
+					"forwarderName": forwarderName,
+					"error":         err.Error()}).Error("Could not resume consumer")
+				c.closeRabbitMQ(params.conn, params.ch)
+				return err
+			}
+		case <-params.probe:
+			params.probe = nil
+			c.breaker.halfOpen()
+			log.WithField("forwarderName", forwarderName).Info("Circuit breaker half-open, probing destination")
+			if err := c.setTripped(params, false); err != nil {
+				log.WithFields(log.Fields{
+					"forwarderName": forwarderName,
+					"error":         err.Error()}).Error("Could not resume consumer")
+				c.closeRabbitMQ(params.conn, params.ch)
+				return err
 			}
 		case <-params.check:
 			log.WithField("forwarderName", forwarderName).Info("Checking")
+		case pause := <-params.pause:
+			if err := c.setPaused(params, pause); err != nil {
+				log.WithFields(log.Fields{
+					"forwarderName": forwarderName,
+					"error":         err.Error()}).Error("Could not change consumer state")
+				c.closeRabbitMQ(params.conn, params.ch)
+				return err
+			}
 		case <-params.stop:
 			log.WithField("forwarderName", forwarderName).Info("Closing")
-			closeRabbitMQ(params.conn, params.ch)
+			c.closeRabbitMQ(params.conn, params.ch)
 			return errors.New(closedBySupervisorMessage)
 		}
 	}
 }
 
+// setPaused cancels or re-registers the consumer, the connection and channel stay open
+func (c Consumer) setPaused(params *workerParams, pause bool) error {
+	if pause == params.paused {
+		return nil
+	}
+	if pause {
+		log.WithField("consumerName", c.Name()).Info("Pausing consumer")
+	} else {
+		log.WithField("consumerName", c.Name()).Info("Resuming consumer")
+	}
+	if err := c.setCancelled(params, &params.paused, pause); err != nil {
+		return err
+	}
+	c.resumeDrain(params)
+	return nil
+}
+
+// trip cancels the consumer while the circuit breaker is open and schedules the probe
+func (c Consumer) trip(params *workerParams) error {
+	probeIn := c.breaker.probeIn()
+	log.WithFields(log.Fields{
+		"consumerName": c.Name(),
+		"probeIn":      probeIn.String()}).Warn("Circuit breaker open, cancelling consumer")
+	if err := c.setTripped(params, true); err != nil {
+		return err
+	}
+	params.probe = time.After(probeIn)
+	return nil
+}
+
+// setTripped cancels or restarts the consumer for the circuit breaker, a paused consumer stays paused
+func (c Consumer) setTripped(params *workerParams, tripped bool) error {
+	if err := c.setCancelled(params, &params.tripped, tripped); err != nil {
+		return err
+	}
+	c.resumeDrain(params)
+	return nil
+}
+
+// setCancelled sets one of the reasons the consumer is cancelled for, the consumer
+// is cancelled or registered again only when the first reason is set or the last cleared
+func (c Consumer) setCancelled(params *workerParams, reason *bool, cancelled bool) error {
+	if *reason == cancelled {
+		return nil
+	}
+	consuming := params.consuming()
+	*reason = cancelled
+	if params.consuming() == consuming {
+		return nil
+	}
+	if err := c.setConsuming(params, !consuming); err != nil {
+		*reason = !cancelled
+		return err
+	}
+	return nil
+}
+
+// consuming whether the consumer is registered, it is cancelled while paused,
+// while the circuit breaker is open and while the spool is full
+func (params *workerParams) consuming() bool {
+	return !params.paused && !params.tripped && !params.spoolFull
+}
+
+// setConsuming cancels the AMQP consumer or registers it again
+func (c Consumer) setConsuming(params *workerParams, consuming bool) error {
+	if !consuming {
+		return params.ch.Cancel(c.Name(), false)
+	}
+	msgs, _, _, err := c.consume(params.ch)
+	if err != nil {
+		return err
+	}
+	params.msgs = msgs
+	return nil
+}
+
 func failOnError(err error, msg string) (<-chan amqp.Delivery, *amqp.Connection, *amqp.Channel, error) {
 	return nil, nil, nil, fmt.Errorf("%s: %s", msg, err)
 }
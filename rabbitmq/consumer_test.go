@@ -0,0 +1,75 @@
+package rabbitmq
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/phorest/rabbit-amazon-forwarder/secrets"
+	"github.com/streadway/amqp"
+)
+
+type failoverConnector struct {
+	refused map[string]bool
+	dialed  []string
+}
+
+func (c *failoverConnector) CreateConnection(connectionURL string) (*amqp.Connection, error) {
+	c.dialed = append(c.dialed, connectionURL)
+	if c.refused[connectionURL] {
+		return nil, errors.New("connection refused")
+	}
+	return &amqp.Connection{}, nil
+}
+
+func (c *failoverConnector) ReleaseConnection(conn *amqp.Connection) error {
+	return nil
+}
+
+func TestDialNodes(t *testing.T) {
+	nodes := []string{"amqp://node-1", "amqp://node-2", "amqp://node-3"}
+	rabbitConnector := &failoverConnector{refused: map[string]bool{"amqp://node-1": true}}
+	consumer := Consumer{ConnectionURLs: nodes, Failover: FailoverOrdered, RabbitConnector: rabbitConnector, SecretResolver: secrets.New()}
+
+	conn, node, err := consumer.dialNodes()
+	if err != nil || conn == nil {
+		t.Fatalf("should fail over to the next node, got error:%v", err)
+	}
+	if node != "amqp://node-2" {
+		t.Errorf("wrong node reported, expected:%s, got:%s", "amqp://node-2", node)
+	}
+	if expected := nodes[:2]; !reflect.DeepEqual(rabbitConnector.dialed, expected) {
+		t.Errorf("wrong nodes dialed, expected:%v, got:%v", expected, rabbitConnector.dialed)
+	}
+
+	rabbitConnector.refused = map[string]bool{"amqp://node-1": true, "amqp://node-2": true, "amqp://node-3": true}
+	if _, _, err := consumer.dialNodes(); err == nil || err.Error() != "Failed to connect to RabbitMQ: connection refused" {
+		t.Errorf("error of the last node should be returned, got:%v", err)
+	}
+}
+
+func TestNodeOrder(t *testing.T) {
+	nodes := []string{"amqp://node-1", "amqp://node-2", "amqp://node-3"}
+	ordered := Consumer{ConnectionURLs: nodes, Failover: FailoverOrdered}
+	if order := ordered.nodeOrder(); !reflect.DeepEqual(order, nodes) {
+		t.Errorf("wrong ordered nodes, expected:%v, got:%v", nodes, order)
+	}
+
+	random := Consumer{ConnectionURLs: nodes, Failover: FailoverRandom}
+	first := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		order := random.nodeOrder()
+		first[order[0]] = true
+		sort.Strings(order)
+		if !reflect.DeepEqual(order, nodes) {
+			t.Fatalf("random order should contain every node once, got:%v", order)
+		}
+	}
+	if len(first) < 2 {
+		t.Errorf("random order should not always start with the same node, got:%v", first)
+	}
+	if !reflect.DeepEqual(random.ConnectionURLs, nodes) {
+		t.Errorf("configured nodes should not be shuffled, got:%v", random.ConnectionURLs)
+	}
+}
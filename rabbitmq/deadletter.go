@@ -0,0 +1,242 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+	"github.com/phorest/rabbit-amazon-forwarder/connector"
+	"github.com/phorest/rabbit-amazon-forwarder/forwarder"
+	"github.com/phorest/rabbit-amazon-forwarder/redact"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// DeadLetterRoutingKeyArgument dead-letter routing key declaration argument, set by the forwarder
+	DeadLetterRoutingKeyArgument = "x-dead-letter-routing-key"
+	// DeadLetterSuffix default suffix of dead-letter exchange and queue names
+	DeadLetterSuffix = "-dead-letter"
+	// DefaultDeadLetterExchangeType default dead-letter exchange type
+	DefaultDeadLetterExchangeType = "fanout"
+	// deadLetterBindingKey binds the dead-letter queue when no routing key is set
+	deadLetterBindingKey = "#"
+	// ErrorHeader forwarding error message of annotated dead-lettered messages
+	ErrorHeader = "x-forwarder-error"
+	// ErrorClassHeader forwarding error class, e.g. AWS error code
+	ErrorClassHeader = "x-forwarder-error-class"
+	// ForwarderHeader name of the forwarder which failed
+	ForwarderHeader = "x-forwarder-name"
+	// QueueHeader queue the message was consumed from
+	QueueHeader = "x-forwarder-queue"
+	// TimestampHeader time the forwarding failed
+	TimestampHeader = "x-forwarder-timestamp"
+	// confirmTimeout how long the consumer waits for the broker to confirm a dead-lettered copy
+	confirmTimeout = 10 * time.Second
+)
+
+// deadLetter dead-letter settings with default names for the queue
+func deadLetter(entry *config.DeadLetterEntry, queueName string) config.DeadLetterEntry {
+	var settings config.DeadLetterEntry
+	if entry != nil {
+		settings = *entry
+	}
+	if settings.Exchange == "" {
+		settings.Exchange = queueName + DeadLetterSuffix
+	}
+	if settings.ExchangeType == "" {
+		settings.ExchangeType = DefaultDeadLetterExchangeType
+	}
+	if settings.Queue == "" {
+		settings.Queue = queueName + DeadLetterSuffix
+	}
+	return settings
+}
+
+// declareDeadLetter declares dead-letter exchange and queue and sets
+// the dead-letter arguments of the regular queue
+func (c Consumer) declareDeadLetter(ch *amqp.Channel, queueArgs amqp.Table) error {
+	if c.DeadLetter.Disabled {
+		return nil
+	}
+	queueArgs[DeadLetterExchangeArgument] = c.DeadLetter.Exchange
+	if c.DeadLetter.RoutingKey != "" {
+		queueArgs[DeadLetterRoutingKeyArgument] = c.DeadLetter.RoutingKey
+	}
+	if c.DeadLetter.SkipDeclare {
+		return nil
+	}
+	var err error
+	if err = ch.ExchangeDeclare(c.DeadLetter.Exchange, c.DeadLetter.ExchangeType, true, false, false, false, nil); err != nil {
+		_, _, _, err = failOnError(err, "Failed to declare an exchange:"+c.DeadLetter.Exchange)
+		return err
+	}
+	if _, err = ch.QueueDeclare(c.DeadLetter.Queue, true, false, false, false, c.deadLetterQueueArgs(queueArgs)); err != nil {
+		_, _, _, err = failOnError(err, "Failed to declare a queue:"+c.DeadLetter.Queue)
+		return err
+	}
+	bindingKey := c.DeadLetter.RoutingKey
+	if bindingKey == "" {
+		bindingKey = deadLetterBindingKey
+	}
+	if err = ch.QueueBind(c.DeadLetter.Queue, bindingKey, c.DeadLetter.Exchange, false, nil); err != nil {
+		_, _, _, err = failOnError(err, "Failed to bind a queue:"+c.DeadLetter.Queue)
+		return err
+	}
+	return nil
+}
+
+// openDeadLetterQueue opens a channel on a separate connection and checks the dead-letter
+// queue exists, the consumer's connection status is not changed
+func (c Consumer) openDeadLetterQueue() (*amqp.Connection, *amqp.Channel, amqp.Queue, error) {
+	if c.DeadLetter.Disabled || queueType(c.QueueArgs) == QueueTypeStream {
+		return nil, nil, amqp.Queue{}, errors.New("rule has no dead-letter queue")
+	}
+	// not shared through the pool, so a blocked shared connection does not block the replay
+	separate := c
+	separate.RabbitConnector = c.separateConnector()
+	conn, _, err := separate.dialNodes()
+	if err != nil {
+		return nil, nil, amqp.Queue{}, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		c.closeDeadLetterQueue(conn, nil)
+		_, _, _, err = failOnError(err, "Failed to open a channel")
+		return nil, nil, amqp.Queue{}, err
+	}
+	queue, err := ch.QueueInspect(c.DeadLetter.Queue)
+	if err != nil {
+		// the broker closes the channel when the queue does not exist
+		c.closeDeadLetterQueue(conn, nil)
+		_, _, _, err = failOnError(err, "Dead-letter queue does not exist:"+c.DeadLetter.Queue)
+		return nil, nil, amqp.Queue{}, err
+	}
+	return conn, ch, queue, nil
+}
+
+func (c Consumer) closeDeadLetterQueue(conn *amqp.Connection, ch *amqp.Channel) {
+	if ch != nil {
+		if err := ch.Close(); err != nil {
+			log.WithField("error", err.Error()).Error("Could not close channel")
+		}
+	}
+	if err := c.separateConnector().ReleaseConnection(conn); err != nil {
+		log.WithField("error", err.Error()).Error("Could not close connection")
+	}
+}
+
+// separateConnector connector dialing a connection of its own instead of the pooled one
+func (c Consumer) separateConnector() connector.RabbitConnector {
+	if shared, ok := c.RabbitConnector.(*connector.SharedRabbitConnector); ok {
+		return shared.Connector
+	}
+	return c.RabbitConnector
+}
+
+// requeue returns fetched messages to the queue
+func requeue(deliveries []amqp.Delivery) {
+	for _, d := range deliveries {
+		if err := d.Nack(false, true); err != nil {
+			log.WithField("error", err.Error()).Error("Could not requeue message")
+		}
+	}
+}
+
+// deadLetterQueueArgs same queue type as the regular queue, with optional TTL and max length
+func (c Consumer) deadLetterQueueArgs(queueArgs amqp.Table) amqp.Table {
+	args := amqp.Table{}
+	if queueType, ok := queueArgs[QueueTypeArgument]; ok {
+		args[QueueTypeArgument] = queueType
+	}
+	if c.DeadLetter.MessageTTL > 0 {
+		args["x-message-ttl"] = int64(c.DeadLetter.MessageTTL)
+	}
+	if c.DeadLetter.MaxLength > 0 {
+		args["x-max-length"] = int64(c.DeadLetter.MaxLength)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// annotatesDeadLetters whether failed messages are republished with error details
+func (c Consumer) annotatesDeadLetters() bool {
+	return c.DeadLetter.Annotate && !c.DeadLetter.Disabled && !c.Passive && queueType(c.QueueArgs) != QueueTypeStream
+}
+
+// confirmPublishing puts the channel in confirm mode, dead-lettered message
+// is acked only after the broker confirmed its copy
+func (c Consumer) confirmPublishing(ch *amqp.Channel) (chan amqp.Confirmation, error) {
+	if err := ch.Confirm(false); err != nil {
+		_, _, _, err = failOnError(err, "Failed to enable publisher confirms")
+		return nil, err
+	}
+	return ch.NotifyPublish(make(chan amqp.Confirmation, 1)), nil
+}
+
+// errConfirmTimeout the broker did not confirm the dead-lettered copy in time
+var errConfirmTimeout = fmt.Errorf("dead-lettered message not confirmed by broker within %s", confirmTimeout)
+
+// publishDeadLetter republishes the failed message to the dead-letter exchange with error details
+func (c Consumer) publishDeadLetter(params *workerParams, d amqp.Delivery, forwardErr error) error {
+	routingKey := c.DeadLetter.RoutingKey
+	if routingKey == "" {
+		routingKey = d.RoutingKey
+	}
+	if err := params.ch.Publish(c.DeadLetter.Exchange, routingKey, false, false, c.annotate(d, params.forwarder.Name(), forwardErr)); err != nil {
+		return err
+	}
+	// the broker holds confirmations back while it raises a memory or disk alarm
+	timer := time.NewTimer(confirmTimeout)
+	defer timer.Stop()
+	select {
+	case confirmation, ok := <-params.confirms:
+		if !ok {
+			return errors.New(channelClosedMessage)
+		}
+		if !confirmation.Ack {
+			return errors.New("dead-lettered message not confirmed by broker")
+		}
+		return nil
+	case <-timer.C:
+		return errConfirmTimeout
+	case <-params.stop:
+		return errors.New(closedBySupervisorMessage)
+	}
+}
+
+// annotate copy of the delivery with forwarding error headers
+func (c Consumer) annotate(d amqp.Delivery, forwarderName string, forwardErr error) amqp.Publishing {
+	headers := amqp.Table{}
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+	headers[ErrorHeader] = redact.URL(forwardErr.Error())
+	headers[ErrorClassHeader] = forwarder.ErrorClass(forwardErr)
+	headers[ForwarderHeader] = forwarderName
+	headers[QueueHeader] = c.QueueName
+	headers[TimestampHeader] = time.Now().UTC()
+	return publishing(d, headers)
+}
+
+// publishing persistent copy of the delivery with the headers
+func publishing(d amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
@@ -0,0 +1,102 @@
+package rabbitmq
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+	"github.com/phorest/rabbit-amazon-forwarder/connector"
+	"github.com/phorest/rabbit-amazon-forwarder/forwarder"
+	"github.com/streadway/amqp"
+)
+
+func TestDeadLetterDefaults(t *testing.T) {
+	settings := deadLetter(nil, "test-queue")
+	expected := config.DeadLetterEntry{Exchange: "test-queue-dead-letter", ExchangeType: "fanout", Queue: "test-queue-dead-letter"}
+	if settings != expected {
+		t.Errorf("wrong default settings, expected:%+v, got:%+v", expected, settings)
+	}
+	settings = deadLetter(&config.DeadLetterEntry{Exchange: "dlx", ExchangeType: "direct", RoutingKey: "test"}, "test-queue")
+	expected = config.DeadLetterEntry{Exchange: "dlx", ExchangeType: "direct", Queue: "test-queue-dead-letter", RoutingKey: "test"}
+	if settings != expected {
+		t.Errorf("wrong settings, expected:%+v, got:%+v", expected, settings)
+	}
+}
+
+func TestDeadLetterQueueArgs(t *testing.T) {
+	consumer := Consumer{DeadLetter: config.DeadLetterEntry{MessageTTL: 60000, MaxLength: 1000}}
+	args := consumer.deadLetterQueueArgs(amqp.Table{QueueTypeArgument: QueueTypeQuorum, "x-max-length": int64(5)})
+	expected := amqp.Table{QueueTypeArgument: QueueTypeQuorum, "x-message-ttl": int64(60000), "x-max-length": int64(1000)}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("wrong dead-letter queue arguments, expected:%v, got:%v", expected, args)
+	}
+	if args := (Consumer{}).deadLetterQueueArgs(amqp.Table{}); args != nil {
+		t.Errorf("classic dead-letter queue should have no arguments, got:%v", args)
+	}
+}
+
+func TestDeclareDeadLetterArguments(t *testing.T) {
+	queueArgs := amqp.Table{}
+	consumer := Consumer{DeadLetter: config.DeadLetterEntry{Exchange: "dlx", RoutingKey: "test", SkipDeclare: true}}
+	if err := consumer.declareDeadLetter(nil, queueArgs); err != nil {
+		t.Fatal(err)
+	}
+	expected := amqp.Table{DeadLetterExchangeArgument: "dlx", DeadLetterRoutingKeyArgument: "test"}
+	if !reflect.DeepEqual(queueArgs, expected) {
+		t.Errorf("wrong queue arguments, expected:%v, got:%v", expected, queueArgs)
+	}
+	queueArgs = amqp.Table{}
+	consumer = Consumer{DeadLetter: config.DeadLetterEntry{Exchange: "dlx", Disabled: true}}
+	if err := consumer.declareDeadLetter(nil, queueArgs); err != nil || len(queueArgs) != 0 {
+		t.Errorf("disabled dead-letter should not set arguments, got:%v", queueArgs)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	consumer := Consumer{QueueName: "test-queue"}
+	delivery := amqp.Delivery{
+		Headers:     amqp.Table{"tenant": "a"},
+		ContentType: "application/json",
+		MessageId:   "id",
+		RoutingKey:  "test",
+		Body:        []byte("{}"),
+	}
+	publishing := consumer.annotate(delivery, "test-lambda", forwarder.Error{Class: "FunctionError", Message: "Unhandled"})
+	if publishing.MessageId != "id" || publishing.ContentType != "application/json" || string(publishing.Body) != "{}" || publishing.DeliveryMode != amqp.Persistent {
+		t.Errorf("message properties not copied, got:%+v", publishing)
+	}
+	expected := map[string]interface{}{
+		"tenant":         "a",
+		ErrorHeader:      "Unhandled",
+		ErrorClassHeader: "FunctionError",
+		ForwarderHeader:  "test-lambda",
+		QueueHeader:      "test-queue",
+	}
+	for key, value := range expected {
+		if publishing.Headers[key] != value {
+			t.Errorf("wrong header %s, expected:%v, got:%v", key, value, publishing.Headers[key])
+		}
+	}
+	if _, ok := publishing.Headers[TimestampHeader].(time.Time); !ok {
+		t.Errorf("timestamp header not set, got:%v", publishing.Headers[TimestampHeader])
+	}
+	if len(delivery.Headers) != 1 {
+		t.Error("original headers should not be modified")
+	}
+	if err := publishing.Headers.Validate(); err != nil {
+		t.Errorf("headers not accepted by amqp: %s", err.Error())
+	}
+}
+
+func TestSeparateConnector(t *testing.T) {
+	basic := connector.CreateBasicRabbitConnector(config.RabbitEntry{}, "rule")
+	consumer := Consumer{RabbitConnector: connector.Share(basic, config.RabbitEntry{})}
+	if consumer.separateConnector() != basic {
+		t.Error("dead-letter queue should not be opened on the shared connection")
+	}
+	consumer = Consumer{RabbitConnector: basic}
+	if consumer.separateConnector() != basic {
+		t.Error("connector which is not shared should be used as is")
+	}
+}
@@ -0,0 +1,35 @@
+package rabbitmq
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// forwarded whether the message was already forwarded, messages without a key and
+// store failures are forwarded again rather than lost
+func (c Consumer) forwarded(forwarderName string, dedupKey string) bool {
+	if c.Dedup == nil || dedupKey == "" {
+		return false
+	}
+	seen, err := c.Dedup.Seen(forwarderName, dedupKey)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"forwarderName": forwarderName,
+			"dedupKey":      dedupKey,
+			"error":         err.Error()}).Warn("Could not check if message was forwarded, forwarding")
+		return false
+	}
+	return seen
+}
+
+// recordForwarded remembers the forwarded message, a failure may only cause a duplicate
+func (c Consumer) recordForwarded(forwarderName string, dedupKey string) {
+	if c.Dedup == nil || dedupKey == "" {
+		return
+	}
+	if err := c.Dedup.Record(forwarderName, dedupKey); err != nil {
+		log.WithFields(log.Fields{
+			"forwarderName": forwarderName,
+			"dedupKey":      dedupKey,
+			"error":         err.Error()}).Warn("Could not record forwarded message")
+	}
+}
@@ -0,0 +1,105 @@
+package rabbitmq
+
+import (
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/consumer"
+	"github.com/phorest/rabbit-amazon-forwarder/redact"
+	"github.com/streadway/amqp"
+)
+
+// Inspect peeks at the first messages of the dead-letter queue,
+// the messages are fetched without ack and requeued
+func (c Consumer) Inspect(limit int) ([]consumer.DeadLetteredMessage, error) {
+	conn, ch, queue, err := c.openDeadLetterQueue()
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeDeadLetterQueue(conn, ch)
+	if limit <= 0 || limit > queue.Messages {
+		limit = queue.Messages
+	}
+	var held []amqp.Delivery
+	defer func() {
+		requeue(held)
+	}()
+	messages := make([]consumer.DeadLetteredMessage, 0, limit)
+	for len(held) < limit {
+		d, ok, err := ch.Get(c.DeadLetter.Queue, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		held = append(held, d)
+		messages = append(messages, inspect(d))
+	}
+	return messages, nil
+}
+
+func inspect(d amqp.Delivery) consumer.DeadLetteredMessage {
+	headers := amqp.Table{}
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+	message := consumer.DeadLetteredMessage{
+		MessageID:  d.MessageId,
+		Exchange:   d.Exchange,
+		RoutingKey: d.RoutingKey,
+		Timestamp:  d.Timestamp,
+		Body:       redact.Fields(d.Body),
+		Deaths:     deaths(headers[deathHeader]),
+		Error:      forwardingError(headers)}
+	// history and annotation are reported separately
+	delete(headers, deathHeader)
+	for _, header := range annotationHeaders {
+		delete(headers, header)
+	}
+	message.Headers = redact.Headers(headers)
+	return message
+}
+
+// deaths parses the x-death header added by the broker
+func deaths(header interface{}) []consumer.Death {
+	entries, ok := header.([]interface{})
+	if !ok {
+		return nil
+	}
+	var deaths []consumer.Death
+	for _, entry := range entries {
+		table, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+		death := consumer.Death{}
+		death.Queue, _ = table["queue"].(string)
+		death.Exchange, _ = table["exchange"].(string)
+		death.Reason, _ = table["reason"].(string)
+		death.Count, _ = table["count"].(int64)
+		death.Time, _ = table["time"].(time.Time)
+		if routingKeys, ok := table["routing-keys"].([]interface{}); ok {
+			for _, routingKey := range routingKeys {
+				if key, ok := routingKey.(string); ok {
+					death.RoutingKeys = append(death.RoutingKeys, key)
+				}
+			}
+		}
+		deaths = append(deaths, death)
+	}
+	return deaths
+}
+
+// forwardingError annotation headers added when dead-lettering with annotate
+func forwardingError(headers amqp.Table) *consumer.ForwardingError {
+	message, ok := headers[ErrorHeader].(string)
+	if !ok {
+		return nil
+	}
+	forwardingError := &consumer.ForwardingError{Message: message}
+	forwardingError.Class, _ = headers[ErrorClassHeader].(string)
+	forwardingError.Forwarder, _ = headers[ForwarderHeader].(string)
+	forwardingError.Queue, _ = headers[QueueHeader].(string)
+	forwardingError.Time, _ = headers[TimestampHeader].(time.Time)
+	return forwardingError
+}
@@ -0,0 +1,43 @@
+package rabbitmq
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/consumer"
+	"github.com/streadway/amqp"
+)
+
+func TestInspectRejected(t *testing.T) {
+	deathTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	d := amqp.Delivery{MessageId: "1", Exchange: "test-queue-dead-letter", RoutingKey: "order.created", Body: []byte("test"), Headers: amqp.Table{
+		"tenant": "a",
+		deathHeader: []interface{}{amqp.Table{"queue": "test-queue", "exchange": "orders", "reason": "rejected",
+			"count": int64(2), "time": deathTime, "routing-keys": []interface{}{"order.created"}}}}}
+	message := inspect(d)
+	expected := consumer.DeadLetteredMessage{MessageID: "1", Exchange: "test-queue-dead-letter", RoutingKey: "order.created",
+		Headers: map[string]interface{}{"tenant": "a"}, Body: "test",
+		Deaths: []consumer.Death{{Queue: "test-queue", Exchange: "orders", RoutingKeys: []string{"order.created"}, Reason: "rejected", Count: 2, Time: deathTime}}}
+	if !reflect.DeepEqual(message, expected) {
+		t.Errorf("wrong message, expected:%+v, got:%+v", expected, message)
+	}
+	if _, ok := d.Headers[deathHeader]; !ok {
+		t.Error("delivery headers should not be changed")
+	}
+}
+
+func TestInspectAnnotated(t *testing.T) {
+	failed := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	d := amqp.Delivery{Body: []byte("test"), Headers: amqp.Table{
+		ErrorHeader: "function failed", ErrorClassHeader: "FunctionError", ForwarderHeader: "test-lambda",
+		QueueHeader: "test-queue", TimestampHeader: failed}}
+	message := inspect(d)
+	expected := &consumer.ForwardingError{Message: "function failed", Class: "FunctionError", Forwarder: "test-lambda", Queue: "test-queue", Time: failed}
+	if !reflect.DeepEqual(message.Error, expected) {
+		t.Errorf("wrong forwarding error, expected:%+v, got:%+v", expected, message.Error)
+	}
+	if len(message.Headers) != 0 || message.Deaths != nil {
+		t.Errorf("annotation should not be repeated in headers, got:%+v", message)
+	}
+}
@@ -0,0 +1,134 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+	"github.com/phorest/rabbit-amazon-forwarder/forwarder"
+	"github.com/phorest/rabbit-amazon-forwarder/jsonfield"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// DefaultOrderingWorkers partitions forwarded concurrently
+	DefaultOrderingWorkers = 4
+	// orderingPrefetch unacknowledged messages per worker
+	orderingPrefetch = 10
+)
+
+// forwardJob message dispatched to the worker of its partition
+type forwardJob struct {
+	delivery amqp.Delivery
+	dedupKey string
+}
+
+// forwardResult outcome handled by the consumer, acks and rejects stay on the channel's goroutine
+type forwardResult struct {
+	delivery amqp.Delivery
+	dedupKey string
+	err      error
+	// requeue not forwarded, the breaker opened while the message waited for its worker
+	requeue bool
+}
+
+// partitions workers forwarding the messages of their partition one at a time in delivery order
+type partitions struct {
+	jobs    []chan forwardJob
+	results chan forwardResult
+	// stopped closed when the connection closed, queued messages are redelivered instead of forwarded
+	stopped chan struct{}
+	workers sync.WaitGroup
+}
+
+// newOrdering zero workers when messages are forwarded one at a time
+func newOrdering(entry *config.OrderingEntry) config.OrderingEntry {
+	if entry == nil {
+		return config.OrderingEntry{}
+	}
+	ordering := *entry
+	if ordering.Workers <= 0 {
+		ordering.Workers = DefaultOrderingWorkers
+	}
+	return ordering
+}
+
+// startPartitions starts the workers for a connection, nil without ordering. Unacknowledged
+// messages are limited by the prefetch so the buffers never block
+func (c Consumer) startPartitions(client forwarder.Client, size int) *partitions {
+	if c.Ordering.Workers <= 0 {
+		return nil
+	}
+	p := &partitions{results: make(chan forwardResult, size), stopped: make(chan struct{})}
+	for i := 0; i < c.Ordering.Workers; i++ {
+		jobs := make(chan forwardJob, size)
+		p.jobs = append(p.jobs, jobs)
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for job := range jobs {
+				select {
+				case <-p.stopped:
+					continue
+				default:
+				}
+				if c.breaker.isOpen() {
+					p.results <- forwardResult{delivery: job.delivery, dedupKey: job.dedupKey, requeue: true}
+					continue
+				}
+				err := client.Push(string(job.delivery.Body), job.delivery.Headers)
+				p.results <- forwardResult{delivery: job.delivery, dedupKey: job.dedupKey, err: err}
+			}
+		}()
+	}
+	return p
+}
+
+// dispatch queues the message behind the earlier messages with the same key
+func (p *partitions) dispatch(key string, job forwardJob) {
+	p.jobs[partition(key, len(p.jobs))] <- job
+}
+
+// stop drops the queued messages and waits for the messages being forwarded, so the
+// redelivered messages are not forwarded concurrently by the workers of the next connection
+func (p *partitions) stop() {
+	if p == nil {
+		return
+	}
+	close(p.stopped)
+	for _, jobs := range p.jobs {
+		close(jobs)
+	}
+	p.workers.Wait()
+}
+
+// partition worker of the key
+func partition(key string, workers int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(workers))
+}
+
+// partitionKey routing key, header or JSON body field, messages without the header or
+// field share the partition of the empty key
+func (c Consumer) partitionKey(d amqp.Delivery) string {
+	switch {
+	case c.Ordering.Header != "":
+		if value, ok := d.Headers[c.Ordering.Header]; ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	case c.Ordering.Field != "":
+		return jsonfield.Value(d.Body, c.Ordering.Field)
+	}
+	return d.RoutingKey
+}
+
+// results outcomes of the workers, nil without ordering so it is never selected
+func (params *workerParams) results() <-chan forwardResult {
+	if params.partitions == nil {
+		return nil
+	}
+	return params.partitions.results
+}
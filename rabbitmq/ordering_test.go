@@ -0,0 +1,162 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+	"github.com/streadway/amqp"
+)
+
+type orderingForwarder struct {
+	mutex  sync.Mutex
+	bodies map[string][]string
+}
+
+func (f *orderingForwarder) Name() string {
+	return "forwarder"
+}
+
+func (f *orderingForwarder) Push(messageBody string, headers map[string]interface{}) error {
+	// later messages of other keys overtake the slow ones
+	time.Sleep(time.Duration(len(messageBody)%3) * time.Millisecond)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	key := fmt.Sprint(headers["entity"])
+	f.bodies[key] = append(f.bodies[key], messageBody)
+	return nil
+}
+
+func TestNewOrdering(t *testing.T) {
+	if ordering := newOrdering(nil); ordering.Workers != 0 {
+		t.Errorf("ordering should be disabled, got:%+v", ordering)
+	}
+	if ordering := newOrdering(&config.OrderingEntry{Header: "entity"}); ordering.Workers != DefaultOrderingWorkers || ordering.Header != "entity" {
+		t.Errorf("wrong ordering, got:%+v", ordering)
+	}
+}
+
+func TestPartitionKey(t *testing.T) {
+	delivery := amqp.Delivery{RoutingKey: "orders", Headers: amqp.Table{"entity": int32(7)}, Body: []byte(`{"order":{"id":12}}`)}
+	scenarios := []struct {
+		ordering config.OrderingEntry
+		key      string
+	}{
+		{config.OrderingEntry{Workers: 2}, "orders"},
+		{config.OrderingEntry{Workers: 2, Header: "entity"}, "7"},
+		{config.OrderingEntry{Workers: 2, Header: "missing"}, ""},
+		{config.OrderingEntry{Workers: 2, Field: "order.id"}, "12"},
+		{config.OrderingEntry{Workers: 2, Field: "order.missing"}, ""},
+	}
+	for _, scenario := range scenarios {
+		consumer := Consumer{Ordering: scenario.ordering}
+		if key := consumer.partitionKey(delivery); key != scenario.key {
+			t.Errorf("wrong partition key for %+v, expected:%s, got:%s", scenario.ordering, scenario.key, key)
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	for _, key := range []string{"", "a", "b", "order-12"} {
+		p := partition(key, 4)
+		if p < 0 || p >= 4 {
+			t.Errorf("partition of %s out of range, got:%d", key, p)
+		}
+		if partition(key, 4) != p {
+			t.Errorf("partition of %s is not stable", key)
+		}
+	}
+}
+
+func TestPartitionsKeepOrderPerKey(t *testing.T) {
+	client := &orderingForwarder{bodies: make(map[string][]string)}
+	consumer := Consumer{Ordering: config.OrderingEntry{Workers: 3, Header: "entity"}}
+	messages := 60
+	partitions := consumer.startPartitions(client, messages)
+	defer partitions.stop()
+	for i := 0; i < messages; i++ {
+		d := amqp.Delivery{Headers: amqp.Table{"entity": i % 5}, Body: []byte(fmt.Sprintf("%d", i))}
+		partitions.dispatch(consumer.partitionKey(d), forwardJob{delivery: d})
+	}
+	for i := 0; i < messages; i++ {
+		select {
+		case result := <-partitions.results:
+			if result.err != nil || result.requeue {
+				t.Errorf("message %s should be forwarded, got:%+v", result.delivery.Body, result)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+	for entity := 0; entity < 5; entity++ {
+		bodies := client.bodies[fmt.Sprint(entity)]
+		for i, body := range bodies {
+			if expected := fmt.Sprint(entity + i*5); body != expected {
+				t.Errorf("entity %d: message %d out of order, expected:%s, got:%s", entity, i, expected, body)
+			}
+		}
+	}
+}
+
+type blockingForwarder struct {
+	started chan bool
+	release chan bool
+	mutex   sync.Mutex
+	pushes  int
+}
+
+func (f *blockingForwarder) Name() string {
+	return "forwarder"
+}
+
+func (f *blockingForwarder) Push(messageBody string, headers map[string]interface{}) error {
+	f.mutex.Lock()
+	f.pushes++
+	f.mutex.Unlock()
+	f.started <- true
+	<-f.release
+	return nil
+}
+
+func TestPartitionsStopDropsQueuedMessages(t *testing.T) {
+	client := &blockingForwarder{started: make(chan bool, 10), release: make(chan bool)}
+	consumer := Consumer{Ordering: config.OrderingEntry{Workers: 1}}
+	partitions := consumer.startPartitions(client, 10)
+	for i := 0; i < 5; i++ {
+		partitions.dispatch("", forwardJob{delivery: amqp.Delivery{Body: []byte(fmt.Sprint(i))}})
+	}
+	<-client.started
+	stopped := make(chan bool)
+	go func() {
+		partitions.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stop should wait for the message being forwarded")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(client.release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for stop")
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.pushes != 1 {
+		t.Errorf("queued messages should not be forwarded after stop, expected:1, got:%d", client.pushes)
+	}
+}
+
+func TestPartitionsDisabled(t *testing.T) {
+	if partitions := (Consumer{}).startPartitions(&orderingForwarder{}, 0); partitions != nil {
+		t.Errorf("partitions should not be started without ordering, got:%+v", partitions)
+	}
+	params := workerParams{}
+	if params.results() != nil {
+		t.Error("results should be nil without ordering")
+	}
+}
@@ -0,0 +1,51 @@
+package rabbitmq
+
+import (
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+)
+
+// rateLimiter token bucket, a message may take a token ahead of time and waits until it is refilled
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// newRateLimiter nil when the rate is not limited, the bucket starts full
+func newRateLimiter(entry config.RateLimitEntry) *rateLimiter {
+	if entry.MessagesPerSecond <= 0 {
+		return nil
+	}
+	burst := float64(rateLimitBurst(entry))
+	return &rateLimiter{rate: entry.MessagesPerSecond, burst: burst, tokens: burst, last: time.Now(), now: time.Now}
+}
+
+// rateLimitBurst burst size, at least one message
+func rateLimitBurst(entry config.RateLimitEntry) int {
+	if entry.Burst < 1 {
+		return 1
+	}
+	return entry.Burst
+}
+
+// reserve takes a token and returns the wait before the message may be forwarded
+func (l *rateLimiter) reserve() time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
@@ -0,0 +1,63 @@
+package rabbitmq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(config.RateLimitEntry{MessagesPerSecond: 2, Burst: 2})
+	limiter.last = now
+	limiter.now = func() time.Time { return now }
+	scenarios := []struct {
+		elapsed time.Duration
+		wait    time.Duration
+	}{
+		{0, 0},
+		{0, 0},
+		{0, 500 * time.Millisecond},
+		{0, time.Second},
+		{2 * time.Second, 0},
+		{10 * time.Second, 0},
+		{0, 0},
+		{0, 500 * time.Millisecond},
+	}
+	for i, scenario := range scenarios {
+		now = now.Add(scenario.elapsed)
+		if wait := limiter.reserve(); wait != scenario.wait {
+			t.Errorf("message %d: wrong wait, expected:%v, got:%v", i, scenario.wait, wait)
+		}
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := newRateLimiter(config.RateLimitEntry{})
+	if limiter != nil {
+		t.Errorf("rate should not be limited, got:%+v", limiter)
+	}
+	if wait := limiter.reserve(); wait != 0 {
+		t.Errorf("unlimited rate should not wait, got:%v", wait)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	scenarios := []struct {
+		consumer  Consumer
+		queueType string
+		prefetch  int
+	}{
+		{Consumer{}, QueueTypeClassic, 0},
+		{Consumer{}, QueueTypeStream, streamPrefetch},
+		{Consumer{RateLimit: config.RateLimitEntry{MessagesPerSecond: 10}}, QueueTypeQuorum, 1},
+		{Consumer{RateLimit: config.RateLimitEntry{MessagesPerSecond: 10, Burst: 20}}, QueueTypeStream, 20},
+		{Consumer{Ordering: config.OrderingEntry{Workers: 4}}, QueueTypeStream, 4 * orderingPrefetch},
+	}
+	for _, scenario := range scenarios {
+		if prefetch := scenario.consumer.prefetch(scenario.queueType); prefetch != scenario.prefetch {
+			t.Errorf("wrong prefetch for %s queue, expected:%d, got:%d", scenario.queueType, scenario.prefetch, prefetch)
+		}
+	}
+}
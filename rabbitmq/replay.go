@@ -0,0 +1,176 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/phorest/rabbit-amazon-forwarder/consumer"
+	"github.com/phorest/rabbit-amazon-forwarder/forwarder"
+	"github.com/phorest/rabbit-amazon-forwarder/redact"
+	"github.com/streadway/amqp"
+)
+
+// deathHeader header added by the broker to dead-lettered messages
+const deathHeader = "x-death"
+
+// annotationHeaders forwarding error headers removed from replayed messages
+var annotationHeaders = []string{ErrorHeader, ErrorClassHeader, ForwarderHeader, QueueHeader, TimestampHeader}
+
+// errReplayConfirmTimeout the broker did not confirm the replayed message in time
+var errReplayConfirmTimeout = fmt.Errorf("replayed message not confirmed by broker within %s", confirmTimeout)
+
+// Replay moves messages from the dead-letter queue back to the exchange they were published to
+// or pushes them through the forwarder. Skipped and previewed messages stay in the queue
+func (c Consumer) Replay(client forwarder.Client, options consumer.ReplayOptions) (consumer.ReplayResult, error) {
+	result := consumer.ReplayResult{DryRun: options.DryRun}
+	if options.Target != "" && options.Target != consumer.ReplayToExchange && options.Target != consumer.ReplayToForwarder {
+		return result, fmt.Errorf("unknown replay target %q, expected one of: %s, %s", options.Target, consumer.ReplayToExchange, consumer.ReplayToForwarder)
+	}
+	conn, ch, queue, err := c.openDeadLetterQueue()
+	if err != nil {
+		return result, err
+	}
+	defer func() {
+		c.closeDeadLetterQueue(conn, ch)
+	}()
+	var confirms chan amqp.Confirmation
+	var returns chan amqp.Return
+	if !options.DryRun && options.Target != consumer.ReplayToForwarder {
+		if confirms, err = c.confirmPublishing(ch); err != nil {
+			return result, err
+		}
+		returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	}
+	// messages are held unacked until the end, so they are not fetched again
+	var held []amqp.Delivery
+	defer func() {
+		requeue(held)
+	}()
+	// at most the messages in the queue at the start are checked
+	for i := 0; i < queue.Messages; i++ {
+		if options.Limit > 0 && result.Replayed >= options.Limit {
+			break
+		}
+		d, ok, err := ch.Get(c.DeadLetter.Queue, false)
+		if err != nil {
+			return result, err
+		}
+		if !ok {
+			break
+		}
+		if !matchHeaders(d.Headers, options.Headers) {
+			held = append(held, d)
+			result.Skipped++
+			continue
+		}
+		if options.DryRun {
+			held = append(held, d)
+			result.Replayed++
+			result.Messages = append(result.Messages, consumer.ReplayedMessage{
+				MessageID:  d.MessageId,
+				RoutingKey: d.RoutingKey,
+				Headers:    redact.Headers(d.Headers),
+				Body:       redact.Fields(d.Body)})
+			continue
+		}
+		if err = c.replay(ch, client, d, options.Target, confirms, returns); err != nil {
+			d.Nack(false, true)
+			if err == errReplayConfirmTimeout {
+				// a late confirmation would be taken for the next message, closing the
+				// channel requeues the held messages
+				held = nil
+				if closeErr := ch.Close(); closeErr != nil {
+					log.WithField("error", closeErr.Error()).Error("Could not close channel")
+				}
+				ch = nil
+			}
+			return result, err
+		}
+		if err = d.Ack(false); err != nil {
+			return result, err
+		}
+		result.Replayed++
+	}
+	log.WithFields(log.Fields{
+		"consumerName": c.Name(),
+		"queueName":    c.DeadLetter.Queue,
+		"replayed":     result.Replayed,
+		"skipped":      result.Skipped,
+		"dryRun":       options.DryRun}).Info("Replayed dead-lettered messages")
+	return result, nil
+}
+
+func (c Consumer) replay(ch *amqp.Channel, client forwarder.Client, d amqp.Delivery, target string, confirms chan amqp.Confirmation, returns chan amqp.Return) error {
+	headers := amqp.Table{}
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+	for _, header := range annotationHeaders {
+		delete(headers, header)
+	}
+	if target == consumer.ReplayToForwarder {
+		return client.Push(string(d.Body), headers)
+	}
+	exchange, routingKey := c.replayDestination(d)
+	// mandatory, unroutable message is returned and stays in the dead-letter queue
+	if err := ch.Publish(exchange, routingKey, true, false, publishing(d, headers)); err != nil {
+		return err
+	}
+	// the broker holds confirmations back while it raises a memory or disk alarm
+	timer := time.NewTimer(confirmTimeout)
+	defer timer.Stop()
+	var confirmation amqp.Confirmation
+	select {
+	case received, ok := <-confirms:
+		if !ok {
+			return errors.New(channelClosedMessage)
+		}
+		confirmation = received
+	case <-timer.C:
+		return errReplayConfirmTimeout
+	}
+	// returns are delivered before the confirmation
+	select {
+	case returned := <-returns:
+		return fmt.Errorf("message not routed by exchange %q with routing key %q: %s", exchange, routingKey, returned.ReplyText)
+	default:
+	}
+	if !confirmation.Ack {
+		return errors.New("replayed message not confirmed by broker")
+	}
+	return nil
+}
+
+// replayDestination exchange and routing key the message was published to, taken from
+// the x-death header of rejected messages, otherwise the rule's exchange or queue
+func (c Consumer) replayDestination(d amqp.Delivery) (string, string) {
+	if deaths, ok := d.Headers[deathHeader].([]interface{}); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			exchange, _ := death["exchange"].(string)
+			if routingKeys, ok := death["routing-keys"].([]interface{}); ok && len(routingKeys) > 0 {
+				if routingKey, ok := routingKeys[0].(string); ok {
+					return exchange, routingKey
+				}
+			}
+		}
+	}
+	// original routing key is unknown, the message goes directly to the queue
+	if c.Passive || c.DeadLetter.RoutingKey != "" {
+		return "", c.QueueName
+	}
+	return c.ExchangeName, d.RoutingKey
+}
+
+// matchHeaders whether the message has all of the header values
+func matchHeaders(headers amqp.Table, filter map[string]string) bool {
+	for name, expected := range filter {
+		value, ok := headers[name]
+		if !ok || fmt.Sprint(value) != expected {
+			return false
+		}
+	}
+	return true
+}
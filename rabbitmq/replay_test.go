@@ -0,0 +1,68 @@
+package rabbitmq
+
+import (
+	"testing"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+	"github.com/phorest/rabbit-amazon-forwarder/consumer"
+	"github.com/streadway/amqp"
+)
+
+func TestReplayDestination(t *testing.T) {
+	rejected := amqp.Delivery{RoutingKey: "test-queue", Headers: amqp.Table{deathHeader: []interface{}{
+		amqp.Table{"exchange": "orders", "queue": "test-queue", "routing-keys": []interface{}{"order.created"}},
+		amqp.Table{"exchange": "older", "routing-keys": []interface{}{"older"}}}}}
+	annotated := amqp.Delivery{RoutingKey: "order.created"}
+	scenarios := []struct {
+		name       string
+		consumer   Consumer
+		delivery   amqp.Delivery
+		exchange   string
+		routingKey string
+	}{
+		{"rejected", Consumer{ExchangeName: "test"}, rejected, "orders", "order.created"},
+		{"annotated", Consumer{ExchangeName: "test"}, annotated, "test", "order.created"},
+		{"passive", Consumer{ExchangeName: "test", QueueName: "test-queue", Passive: true}, annotated, "", "test-queue"},
+		{"dead-letter routing key", Consumer{ExchangeName: "test", QueueName: "test-queue", DeadLetter: config.DeadLetterEntry{RoutingKey: "dead"}}, annotated, "", "test-queue"},
+	}
+	for _, scenario := range scenarios {
+		exchange, routingKey := scenario.consumer.replayDestination(scenario.delivery)
+		if exchange != scenario.exchange || routingKey != scenario.routingKey {
+			t.Errorf("%s: wrong destination, expected:%s %s, got:%s %s", scenario.name, scenario.exchange, scenario.routingKey, exchange, routingKey)
+		}
+	}
+}
+
+func TestMatchHeaders(t *testing.T) {
+	headers := amqp.Table{"tenant": "a", "attempt": int32(3)}
+	scenarios := []struct {
+		filter  map[string]string
+		matches bool
+	}{
+		{nil, true},
+		{map[string]string{"tenant": "a"}, true},
+		{map[string]string{"tenant": "a", "attempt": "3"}, true},
+		{map[string]string{"tenant": "b"}, false},
+		{map[string]string{"missing": ""}, false},
+	}
+	for _, scenario := range scenarios {
+		if matches := matchHeaders(headers, scenario.filter); matches != scenario.matches {
+			t.Errorf("wrong match for filter %v, expected:%t, got:%t", scenario.filter, scenario.matches, matches)
+		}
+	}
+}
+
+func TestReplayWithoutDeadLetterQueue(t *testing.T) {
+	scenarios := []Consumer{
+		{DeadLetter: config.DeadLetterEntry{Disabled: true}},
+		{QueueArgs: amqp.Table{QueueTypeArgument: QueueTypeStream}},
+	}
+	for _, c := range scenarios {
+		if _, err := c.Replay(nil, consumer.ReplayOptions{}); err == nil {
+			t.Errorf("replay should fail without dead-letter queue, consumer:%+v", c)
+		}
+	}
+	if _, err := (Consumer{}).Replay(nil, consumer.ReplayOptions{Target: "queue"}); err == nil {
+		t.Error("replay should fail for unknown target")
+	}
+}
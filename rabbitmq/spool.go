@@ -0,0 +1,195 @@
+package rabbitmq
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+	"github.com/phorest/rabbit-amazon-forwarder/consumer"
+	"github.com/phorest/rabbit-amazon-forwarder/forwarder"
+	"github.com/phorest/rabbit-amazon-forwarder/spool"
+	"github.com/streadway/amqp"
+)
+
+// SpoolStats pending messages of the spool, false when not configured
+func (c Consumer) SpoolStats() (consumer.SpoolStats, bool) {
+	if c.Spool == nil {
+		return consumer.SpoolStats{}, false
+	}
+	stats := c.Spool.Stats()
+	return consumer.SpoolStats{Messages: stats.Messages, Bytes: stats.Bytes, MaxBytes: stats.MaxBytes, Failed: stats.Failed}, true
+}
+
+func (c Consumer) openSpool(forwarderName string) error {
+	if c.Spool == nil {
+		return nil
+	}
+	if err := c.Spool.Open(forwarderName); err != nil {
+		return err
+	}
+	if pending := c.Spool.Pending(); pending > 0 {
+		log.WithFields(log.Fields{
+			"forwarderName": forwarderName,
+			"pending":       pending}).Info("Spool has pending messages, draining once connected")
+	}
+	return nil
+}
+
+func (c Consumer) closeSpool() {
+	if c.Spool == nil {
+		return
+	}
+	if err := c.Spool.Close(); err != nil {
+		log.WithField("error", err.Error()).Error("Could not close spool")
+	}
+}
+
+// spoolDelivery writes the message to the spool and acks it, false when it is handled without
+// the spool. When the spool is full the message is requeued and the consumer cancelled until the
+// spool drained, so the backlog stays in the queue and the spool keeps the order
+func (c Consumer) spoolDelivery(params *workerParams, d amqp.Delivery, dedupKey string) (bool, error) {
+	if c.Spool == nil {
+		return false, nil
+	}
+	draining := c.Spool.Pending() > 0
+	err := c.Spool.Append(spool.Message{MessageID: d.MessageId, Body: string(d.Body), Headers: d.Headers, DedupKey: dedupKey})
+	if err == spool.ErrFull {
+		log.WithFields(log.Fields{
+			"consumerName": c.Name(),
+			"messageID":    d.MessageId}).Warn("Spool is full, requeueing message and cancelling consumer until it drains")
+		if err := d.Nack(false, true); err != nil {
+			log.WithFields(log.Fields{
+				"consumerName": c.Name(),
+				"error":        err.Error(),
+				"messageID":    d.MessageId}).Error("Could not requeue message")
+			return true, err
+		}
+		if err := c.setCancelled(params, &params.spoolFull, true); err != nil {
+			log.WithFields(log.Fields{
+				"consumerName": c.Name(),
+				"error":        err.Error()}).Error("Could not cancel consumer")
+			c.closeRabbitMQ(params.conn, params.ch)
+			return true, err
+		}
+		return true, nil
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"consumerName": c.Name(),
+			"messageID":    d.MessageId,
+			"error":        err.Error()}).Error("Could not spool message")
+		return false, nil
+	}
+	log.WithFields(log.Fields{
+		"consumerName": c.Name(),
+		"messageID":    d.MessageId}).Info("Spooled message")
+	if !draining {
+		// the destination just failed, the first drain attempt backs off
+		wait, _ := params.drainBackoff.next()
+		params.drain = time.After(wait)
+	}
+	if err := d.Ack(false); err != nil {
+		log.WithFields(log.Fields{
+			"consumerName": c.Name(),
+			"error":        err.Error(),
+			"messageID":    d.MessageId}).Error("Could not ack spooled message")
+		return true, err
+	}
+	return true, nil
+}
+
+// drainSpool forwards the oldest spooled message, retryable failures back off and
+// messages rejected by the destination are moved to the failed log. A consumer cancelled
+// because the spool was full is registered again once the spool drained. Nothing is
+// drained while the rule is paused or the circuit breaker is open, resumeDrain restarts it
+func (c Consumer) drainSpool(params *workerParams, forwarderName string) error {
+	params.drain = nil
+	if params.paused || params.tripped {
+		return nil
+	}
+	message, ok, err := c.Spool.Peek()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"forwarderName": forwarderName,
+			"error":         err.Error()}).Error("Could not read spool")
+		c.retryDrain(params)
+		return nil
+	}
+	if !ok {
+		params.drainBackoff.reset()
+		return c.setCancelled(params, &params.spoolFull, false)
+	}
+	// the token is taken once, the timer lets the message through
+	if !params.drainReserved {
+		if wait := params.limiter.reserve(); wait > 0 {
+			params.drainReserved = true
+			params.drain = time.After(wait)
+			return nil
+		}
+	}
+	params.drainReserved = false
+	err = params.forwarder.Push(message.Body, message.Headers)
+	if c.breaker.record(err != nil) {
+		if tripErr := c.trip(params); tripErr != nil {
+			return tripErr
+		}
+	}
+	switch {
+	case err == nil:
+		c.recordForwarded(forwarderName, message.DedupKey)
+		if err = c.Spool.Commit(); err != nil {
+			log.WithFields(log.Fields{
+				"forwarderName": forwarderName,
+				"messageID":     message.MessageID,
+				"error":         err.Error()}).Error("Could not remove forwarded message from spool")
+			c.retryDrain(params)
+			return nil
+		}
+		params.drainBackoff.reset()
+	case forwarder.Retryable(err):
+		log.WithFields(log.Fields{
+			"forwarderName": forwarderName,
+			"pending":       c.Spool.Pending(),
+			"error":         err.Error()}).Warn("Destination still failing, keeping spooled messages")
+		c.retryDrain(params)
+		return nil
+	default:
+		log.WithFields(log.Fields{
+			"forwarderName": forwarderName,
+			"messageID":     message.MessageID,
+			"error":         err.Error()}).Error("Destination rejected spooled message, moving it to the failed log")
+		if err = c.Spool.Fail(); err != nil {
+			log.WithFields(log.Fields{
+				"forwarderName": forwarderName,
+				"error":         err.Error()}).Error("Could not move message to the failed log")
+			c.retryDrain(params)
+			return nil
+		}
+	}
+	if c.Spool.Pending() > 0 {
+		params.drain = time.After(0)
+		return nil
+	}
+	return c.setCancelled(params, &params.spoolFull, false)
+}
+
+func (c Consumer) retryDrain(params *workerParams) {
+	wait, _ := params.drainBackoff.next()
+	params.drain = time.After(wait)
+}
+
+// newSpool nil when spooling is not configured
+func newSpool(entry *config.SpoolEntry) *spool.Spool {
+	if entry == nil {
+		return nil
+	}
+	return spool.New(entry.Dir, entry.MaxSize)
+}
+
+// resumeDrain schedules draining the spool again once the rule is resumed or the circuit breaker closes
+func (c Consumer) resumeDrain(params *workerParams) {
+	if params.drain == nil && !params.paused && !params.tripped && c.Spool.Pending() > 0 {
+		params.drain = time.After(0)
+	}
+}
@@ -0,0 +1,117 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/phorest/rabbit-amazon-forwarder/connector"
+	"github.com/phorest/rabbit-amazon-forwarder/redact"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// StateConnecting consumer is connecting or waiting to reconnect
+	StateConnecting = "connecting"
+	// StateConnected consumer is connected and consuming
+	StateConnected = "connected"
+	// StateBlocked broker blocked publishing on the connection, e.g. memory or disk alarm
+	StateBlocked = "blocked"
+	// StateClosed channel or connection was closed by the broker
+	StateClosed = "closed"
+	// StateCancelled consumer was cancelled by the broker, e.g. queue deleted
+	StateCancelled = "cancelled"
+)
+
+// connectionStatus connected node and connection state, shared by consumer copies
+type connectionStatus struct {
+	mutex  sync.Mutex
+	url    string
+	conn   *amqp.Connection
+	state  string
+	reason string
+	// blocked blocked state of the connection, watched once by the connection pool
+	blocked func(conn *amqp.Connection) amqp.Blocking
+}
+
+// newConnectionStatus status of a connecting consumer, blocked connections are reported
+// when the connector shares them through the pool
+func newConnectionStatus(rabbitConnector connector.RabbitConnector) *connectionStatus {
+	status := &connectionStatus{state: StateConnecting}
+	if reporter, ok := rabbitConnector.(connector.BlockedReporter); ok {
+		status.blocked = reporter.Blocked
+	}
+	return status
+}
+
+func (s *connectionStatus) node() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.url
+}
+
+func (s *connectionStatus) get() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, reason := s.state, s.reason
+	if state == StateConnected && s.conn != nil && s.blocked != nil {
+		if blocking := s.blocked(s.conn); blocking.Active {
+			state, reason = StateBlocked, blocking.Reason
+		}
+	}
+	if reason == "" {
+		return state
+	}
+	return state + ": " + reason
+}
+
+func (s *connectionStatus) set(state string, reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state = state
+	s.reason = redact.URL(reason)
+}
+
+// connected records the node and the connection whose blocked state is reported
+func (s *connectionStatus) connected(conn *amqp.Connection, connectionURL string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conn = conn
+	s.url = redact.URL(connectionURL)
+}
+
+func (s *connectionStatus) disconnected() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conn = nil
+	s.url = ""
+}
+
+// reportClosed logs and records why the channel stopped delivering, reason may be
+// delivered after the deliveries channel closes so pending notifications are checked
+func (c Consumer) reportClosed(params *workerParams, closeErr *amqp.Error, tag string) {
+	if closeErr == nil && tag == "" {
+		select {
+		case closeErr = <-params.closed:
+		case tag = <-params.cancelled:
+		default:
+		}
+	}
+	switch {
+	case tag != "":
+		log.WithFields(log.Fields{
+			"consumerName": c.Name(),
+			"queueName":    c.QueueName}).Warn("Consumer cancelled by broker, queue may have been deleted")
+		c.status.set(StateCancelled, fmt.Sprintf("queue %s", c.QueueName))
+	case closeErr != nil:
+		log.WithFields(log.Fields{
+			"consumerName": c.Name(),
+			"code":         closeErr.Code,
+			"reason":       closeErr.Reason,
+			"server":       closeErr.Server}).Warn("Channel closed by broker")
+		c.status.set(StateClosed, fmt.Sprintf("%d %s", closeErr.Code, closeErr.Reason))
+	default:
+		c.status.set(StateClosed, "")
+	}
+}
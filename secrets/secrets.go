@@ -0,0 +1,135 @@
+package secrets
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// FileScheme reference to a file containing the secret
+	FileScheme = "file://"
+	// SecretsManagerScheme reference to an AWS Secrets Manager secret name or ARN
+	SecretsManagerScheme = "secretsmanager://"
+	// EmptySecretError empty secret error message
+	EmptySecretError = "secret is empty"
+)
+
+// Resolver interface for resolving secret references
+type Resolver interface {
+	Resolve(value string) (string, error)
+}
+
+// FileReader interface for reading secret files
+type FileReader interface {
+	ReadFile(filename string) ([]byte, error)
+}
+
+type ioFileReader struct{}
+
+func (r ioFileReader) ReadFile(filename string) ([]byte, error) {
+	return ioutil.ReadFile(filename)
+}
+
+// Default resolver shared by all consumers
+var Default = New()
+
+// Client resolves file:// and secretsmanager:// references,
+// any other value is returned unchanged
+type Client struct {
+	fileReader     FileReader
+	secretsManager *secretsManager
+}
+
+// secretsManager AWS client created on the first secretsmanager:// reference, so
+// mappings without references do not need AWS configuration
+type secretsManager struct {
+	once   sync.Once
+	client secretsmanageriface.SecretsManagerAPI
+	err    error
+}
+
+// New creates secrets client
+func New(secretsManagerClient ...secretsmanageriface.SecretsManagerAPI) Client {
+	manager := &secretsManager{}
+	if len(secretsManagerClient) > 0 {
+		manager.client = secretsManagerClient[0]
+	}
+	return Client{ioFileReader{}, manager}
+}
+
+func (s *secretsManager) get() (secretsmanageriface.SecretsManagerAPI, error) {
+	s.once.Do(func() {
+		if s.client != nil {
+			return
+		}
+		awsSession, err := session.NewSession()
+		if err != nil {
+			s.err = err
+			return
+		}
+		s.client = secretsmanager.New(awsSession)
+	})
+	return s.client, s.err
+}
+
+// IsReference checks if value is a secret reference
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, FileScheme) || strings.HasPrefix(value, SecretsManagerScheme)
+}
+
+// Resolve reads the referenced secret, it is read on every call so rotated secrets are picked up
+func (c Client) Resolve(value string) (string, error) {
+	var secret string
+	var err error
+	switch {
+	case strings.HasPrefix(value, FileScheme):
+		secret, err = c.readFile(strings.TrimPrefix(value, FileScheme))
+	case strings.HasPrefix(value, SecretsManagerScheme):
+		secret, err = c.readSecretsManager(strings.TrimPrefix(value, SecretsManagerScheme))
+	default:
+		return value, nil
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"reference": value,
+			"error":     err.Error()}).Error("Could not resolve secret")
+		return "", err
+	}
+	if secret == "" {
+		return "", errors.New(EmptySecretError)
+	}
+	return secret, nil
+}
+
+func (c Client) readFile(filePath string) (string, error) {
+	data, err := c.fileReader.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (c Client) readSecretsManager(secretID string) (string, error) {
+	client, err := c.secretsManager.get()
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.SecretString != nil {
+		return strings.TrimSpace(*resp.SecretString), nil
+	}
+	return strings.TrimSpace(string(resp.SecretBinary)), nil
+}
@@ -1,19 +1,46 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/phorest/rabbit-amazon-forwarder/config"
+	"github.com/phorest/rabbit-amazon-forwarder/consumer"
 	"github.com/phorest/rabbit-amazon-forwarder/mapping"
+	"github.com/phorest/rabbit-amazon-forwarder/redact"
 	"github.com/phorest/rabbit-amazon-forwarder/supervisor"
 	log "github.com/sirupsen/logrus"
-	"net/http"
-	"os"
 )
 
 const (
 	LogLevel = "LOG_LEVEL"
+	// validateCommand checks the mapping and exits
+	validateCommand = "validate"
+	// replayCommand replays dead-lettered messages of a rule and exits
+	replayCommand = "replay"
+	// defaultReloadInterval seconds between mapping file change checks
+	defaultReloadInterval = 10
 )
 
 func main() {
 	createLogger()
+	// random failover order of broker nodes differs between instances
+	rand.Seed(time.Now().UnixNano())
+	if len(os.Args) > 1 && os.Args[1] == validateCommand {
+		os.Exit(validate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == replayCommand {
+		os.Exit(replay(os.Args[2:]))
+	}
 
 	consumerForwarderMapping, err := mapping.New().Load()
 	if err != nil {
@@ -23,14 +50,22 @@ func main() {
 	if err := supervisor.Start(); err != nil {
 		log.WithField("error", err.Error()).Fatal("Could not start supervisor")
 	}
+	watchMapping(&supervisor)
 	http.HandleFunc("/restart", supervisor.Restart)
+	http.HandleFunc("/reload", supervisor.Reload)
 	http.HandleFunc("/health", supervisor.Check)
+	http.HandleFunc("/rules", supervisor.Rules)
+	http.HandleFunc("/rules/pause", supervisor.Pause)
+	http.HandleFunc("/rules/resume", supervisor.Resume)
+	http.HandleFunc("/rules/restart", supervisor.RestartRule)
+	http.HandleFunc("/rules/replay", supervisor.ReplayDeadLetters)
+	http.HandleFunc("/rules/dead-letters", supervisor.InspectDeadLetters)
 	log.Info("Starting http server")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
 func createLogger() {
-	log.SetFormatter(&log.JSONFormatter{})
+	log.SetFormatter(redact.Formatter{Formatter: &log.JSONFormatter{}})
 	log.SetOutput(os.Stdout)
 	log.SetLevel(log.InfoLevel)
 	if logLevel := os.Getenv(LogLevel); logLevel != "" {
@@ -40,4 +75,135 @@ func createLogger() {
 			log.SetLevel(level)
 		}
 	}
+	settings := redact.Settings{
+		BodyMaxLength: redact.DefaultBodyMaxLength,
+		Headers:       redact.ParseList(os.Getenv(config.RedactHeaders)),
+		Fields:        redact.ParseList(os.Getenv(config.RedactFields)),
+	}
+	if value := os.Getenv(config.LogBodyMaxLength); value != "" {
+		var err error
+		if settings.BodyMaxLength, err = strconv.Atoi(value); err != nil {
+			log.WithField("error", err.Error()).Fatalf("Could not parse %s", config.LogBodyMaxLength)
+		}
+	}
+	redact.Configure(settings)
+}
+
+// validate checks the mapping offline, mapping file or directory can be passed as an argument
+func validate(args []string) int {
+	if len(args) > 0 {
+		if info, err := os.Stat(args[0]); err == nil && info.IsDir() {
+			os.Setenv(config.MappingDir, args[0])
+			os.Unsetenv(config.MappingFile)
+		} else {
+			os.Setenv(config.MappingFile, args[0])
+		}
+	}
+	err := mapping.New().Validate()
+	if err == nil {
+		fmt.Println("Mapping is valid")
+		return 0
+	}
+	if validationError, ok := err.(mapping.ValidationError); ok {
+		for _, problem := range validationError.Problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	return 1
+}
+
+// headerFlags repeated name:value header filter flags
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ",")
+}
+
+func (h *headerFlags) Set(value string) error {
+	*h = append(*h, value)
+	return nil
+}
+
+// replay moves dead-lettered messages of the named rule back, the result is printed as JSON
+func replay(args []string) int {
+	flags := flag.NewFlagSet(replayCommand, flag.ContinueOnError)
+	limit := flags.Int("limit", 0, "maximal number of replayed messages, 0 replays all")
+	dryRun := flags.Bool("dry-run", false, "list the messages which would be replayed without changing the queue")
+	target := flags.String("target", consumer.ReplayToExchange, "replay to the original exchange or directly through the rule's forwarder: exchange, forwarder")
+	var headers headerFlags
+	flags.Var(&headers, "header", "replay only messages with the name:value header, can be repeated")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] RULE_NAME\n", os.Args[0], replayCommand)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	filter, err := consumer.ParseHeaderFilter(headers)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	// the result is the only output on stdout
+	log.SetOutput(os.Stderr)
+	mappings, err := mapping.New().Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	for _, mappingEntry := range mappings {
+		if mappingEntry.Forwarder.Name() != flags.Arg(0) {
+			continue
+		}
+		replayer, ok := mappingEntry.Consumer.(consumer.Replayer)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Rule %s does not support dead-letter replay\n", flags.Arg(0))
+			return 1
+		}
+		result, err := replayer.Replay(mappingEntry.Forwarder, consumer.ReplayOptions{Limit: *limit, Headers: filter, DryRun: *dryRun, Target: *target})
+		output, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(output))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, redact.URL(err.Error()))
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "Rule %s not found\n", flags.Arg(0))
+	return 1
+}
+
+// watchMapping reloads the mapping on SIGHUP and on mapping file or directory changes
+func watchMapping(supervisor *supervisor.Client) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info("Received SIGHUP, reloading mapping")
+			supervisor.ReloadMappings()
+		}
+	}()
+	mappingPath := os.Getenv(config.MappingFile)
+	if mappingPath == "" {
+		mappingPath = os.Getenv(config.MappingDir)
+	}
+	if mappingPath == "" {
+		return
+	}
+	interval := defaultReloadInterval
+	if value := os.Getenv(config.MappingReloadInterval); value != "" {
+		var err error
+		if interval, err = strconv.Atoi(value); err != nil {
+			log.WithField("error", err.Error()).Fatalf("Could not parse %s", config.MappingReloadInterval)
+		}
+	}
+	if interval > 0 {
+		go supervisor.Watch(mappingPath, time.Duration(interval)*time.Second)
+	}
 }
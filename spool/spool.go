@@ -0,0 +1,406 @@
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultMaxSize megabytes of pending messages per rule
+	DefaultMaxSize = 1024
+	// LogFile append-only log of spooled messages
+	LogFile = "spool.log"
+	// OffsetFile position of the oldest pending message in the log
+	OffsetFile = "spool.offset"
+	// FailedFile messages the destination rejected while draining
+	FailedFile = "failed.log"
+	// headerSize record length prefix
+	headerSize = 4
+)
+
+// ErrFull the spool reached its maximal size
+var ErrFull = errors.New("spool is full")
+
+// paths spool directories opened by this process, a reloaded rule waits until
+// the previous consumer closed the spool
+var (
+	pathsMutex sync.Mutex
+	paths      = make(map[string]*sync.Mutex)
+)
+
+// Message spooled message
+type Message struct {
+	MessageID string                 `json:"messageId"`
+	Body      string                 `json:"body"`
+	Headers   map[string]interface{} `json:"headers"`
+	// DedupKey recorded once the message is forwarded
+	DedupKey string `json:"dedupKey,omitempty"`
+}
+
+// Stats pending and failed messages
+type Stats struct {
+	Messages int
+	Bytes    int64
+	MaxBytes int64
+	Failed   int
+}
+
+// Spool durable FIFO of messages in a directory per rule, every record is a length
+// prefixed JSON message. Consumed records are skipped by the offset and the log is
+// truncated once it is drained
+type Spool struct {
+	mutex    sync.Mutex
+	dir      string
+	maxBytes int64
+	path     string
+	lock     *sync.Mutex
+	log      *os.File
+	offset   int64
+	size     int64
+	messages int
+	failed   int
+}
+
+// New creates spool in the directory, maxSize in megabytes, it is opened by the consumer
+func New(dir string, maxSize int) *Spool {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	return &Spool{dir: dir, maxBytes: int64(maxSize) << 20}
+}
+
+// Open opens the spool of the rule, a record partially written before a crash is dropped
+func (s *Spool) Open(name string) error {
+	path := filepath.Join(s.dir, name)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+	lock := pathLock(path)
+	lock.Lock()
+	log, err := os.OpenFile(filepath.Join(path, LogFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		lock.Unlock()
+		return err
+	}
+	offset, err := readOffset(path)
+	if err != nil {
+		log.Close()
+		lock.Unlock()
+		return err
+	}
+	messages, size, err := scan(log, offset)
+	if err != nil {
+		// offset beyond a log truncated by hand
+		offset = 0
+		messages, size, err = scan(log, offset)
+	}
+	if err == nil {
+		err = log.Truncate(size)
+	}
+	if err != nil {
+		log.Close()
+		lock.Unlock()
+		return err
+	}
+	failed, _, err := scanFile(filepath.Join(path, FailedFile))
+	if err != nil {
+		log.Close()
+		lock.Unlock()
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.path, s.lock, s.log = path, lock, log
+	s.offset, s.size, s.messages, s.failed = offset, size, messages, failed
+	return nil
+}
+
+// Close closes the log, the spool can be opened again
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.Close()
+	s.log = nil
+	s.lock.Unlock()
+	return err
+}
+
+// Pending number of messages waiting to be forwarded, 0 for a missing spool
+func (s *Spool) Pending() int {
+	if s == nil {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.messages
+}
+
+// Stats pending messages and their size
+func (s *Spool) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return Stats{Messages: s.messages, Bytes: s.size - s.offset, MaxBytes: s.maxBytes, Failed: s.failed}
+}
+
+// Append writes the message to disk, it is durable when Append returns
+func (s *Spool) Append(message Message) error {
+	record, err := encode(message)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.log == nil {
+		return errors.New("spool is not open")
+	}
+	if s.size-s.offset+int64(len(record)) > s.maxBytes {
+		return ErrFull
+	}
+	if _, err := s.log.WriteAt(record, s.size); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(record))
+	s.messages++
+	return nil
+}
+
+// Peek oldest pending message, false when the spool is empty
+func (s *Spool) Peek() (Message, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.log == nil || s.messages == 0 {
+		return Message{}, false, nil
+	}
+	data, err := readRecord(s.log, s.offset)
+	if err != nil {
+		return Message{}, false, err
+	}
+	var message Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		return Message{}, false, err
+	}
+	return message, true, nil
+}
+
+// Commit drops the oldest message once it was forwarded
+func (s *Spool) Commit() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.commit()
+}
+
+// Fail moves the oldest message to the failed log, the destination rejected it
+func (s *Spool) Fail() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.log == nil || s.messages == 0 {
+		return nil
+	}
+	data, err := readRecord(s.log, s.offset)
+	if err != nil {
+		return err
+	}
+	failed, err := os.OpenFile(filepath.Join(s.path, FailedFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer failed.Close()
+	if _, err := failed.Write(frame(data)); err != nil {
+		return err
+	}
+	if err := failed.Sync(); err != nil {
+		return err
+	}
+	s.failed++
+	return s.commit()
+}
+
+func (s *Spool) commit() error {
+	if s.log == nil || s.messages == 0 {
+		return nil
+	}
+	length, err := readLength(s.log, s.offset)
+	if err != nil {
+		return err
+	}
+	s.offset += headerSize + length
+	s.messages--
+	if s.messages == 0 {
+		// drained, a crash before truncating replays the messages again rather than losing any
+		if err := writeOffset(s.path, 0); err != nil {
+			return err
+		}
+		if err := s.log.Truncate(0); err != nil {
+			return err
+		}
+		s.offset, s.size = 0, 0
+		return nil
+	}
+	if s.offset > s.maxBytes {
+		if err := s.compact(); err != nil {
+			return err
+		}
+	}
+	return writeOffset(s.path, s.offset)
+}
+
+// compact copies the pending messages to a new log, so a spool which never
+// drains completely does not grow without limit
+func (s *Spool) compact() error {
+	logPath := filepath.Join(s.path, LogFile)
+	compacted, err := os.OpenFile(logPath+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(compacted, io.NewSectionReader(s.log, s.offset, s.size-s.offset)); err != nil {
+		compacted.Close()
+		return err
+	}
+	if err := compacted.Sync(); err != nil {
+		compacted.Close()
+		return err
+	}
+	// the offset is written before the rename, a crash in between replays the messages again
+	if err := writeOffset(s.path, 0); err != nil {
+		compacted.Close()
+		return err
+	}
+	if err := os.Rename(logPath+".tmp", logPath); err != nil {
+		compacted.Close()
+		return err
+	}
+	s.log.Close()
+	s.log = compacted
+	s.size -= s.offset
+	s.offset = 0
+	return nil
+}
+
+func pathLock(path string) *sync.Mutex {
+	pathsMutex.Lock()
+	defer pathsMutex.Unlock()
+	lock, ok := paths[path]
+	if !ok {
+		lock = &sync.Mutex{}
+		paths[path] = lock
+	}
+	return lock
+}
+
+func encode(message Message) ([]byte, error) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return frame(data), nil
+}
+
+func frame(data []byte) []byte {
+	record := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[headerSize:], data)
+	return record
+}
+
+func readLength(file *os.File, offset int64) (int64, error) {
+	header := make([]byte, headerSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint32(header)), nil
+}
+
+func readRecord(file *os.File, offset int64) ([]byte, error) {
+	length, err := readLength(file, offset)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset+headerSize); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// scan counts complete records from the offset and returns the end of the last one
+func scan(file *os.File, offset int64) (int, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if offset > info.Size() {
+		return 0, 0, fmt.Errorf("offset %d beyond log size %d", offset, info.Size())
+	}
+	messages := 0
+	for offset+headerSize <= info.Size() {
+		length, err := readLength(file, offset)
+		if err != nil {
+			return 0, 0, err
+		}
+		if offset+headerSize+length > info.Size() {
+			break
+		}
+		offset += headerSize + length
+		messages++
+	}
+	return messages, offset, nil
+}
+
+func scanFile(path string) (int, int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	return scan(file, 0)
+}
+
+func readOffset(path string) (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, OffsetFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// writeOffset replaces the offset file atomically
+func writeOffset(path string, offset int64) error {
+	offsetPath := filepath.Join(path, OffsetFile)
+	file, err := os.OpenFile(offsetPath+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(strconv.FormatInt(offset, 10)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(offsetPath+".tmp", offsetPath)
+}
@@ -0,0 +1,146 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempSpool(t *testing.T, maxSize int) (*Spool, string) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(dir, maxSize)
+	if err := s.Open("test-rule"); err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func appendMessages(t *testing.T, s *Spool, bodies ...string) {
+	for _, body := range bodies {
+		if err := s.Append(Message{Body: body, Headers: map[string]interface{}{"tenant": "a"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectNext(t *testing.T, s *Spool, body string) {
+	message, ok, err := s.Peek()
+	if err != nil || !ok || message.Body != body || message.Headers["tenant"] != "a" {
+		t.Fatalf("wrong next message, expected:%s, got:%+v %t %v", body, message, ok, err)
+	}
+}
+
+func TestSpoolOrder(t *testing.T) {
+	s, dir := tempSpool(t, 1)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	appendMessages(t, s, "1", "2", "3")
+	for _, body := range []string{"1", "2", "3"} {
+		expectNext(t, s, body)
+		if err := s.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok, _ := s.Peek(); ok || s.Pending() != 0 {
+		t.Error("drained spool should be empty")
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "test-rule", LogFile)); info.Size() != 0 {
+		t.Errorf("drained log should be truncated, got:%d bytes", info.Size())
+	}
+}
+
+func TestSpoolReopen(t *testing.T) {
+	s, dir := tempSpool(t, 1)
+	defer os.RemoveAll(dir)
+	appendMessages(t, s, "1", "2", "3")
+	s.Commit()
+	s.Close()
+	// record partially written before a crash
+	log, err := os.OpenFile(filepath.Join(dir, "test-rule", LogFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Write([]byte{0, 0, 1, 0, '{'})
+	log.Close()
+
+	reopened := New(dir, 1)
+	if err := reopened.Open("test-rule"); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Pending() != 2 {
+		t.Errorf("wrong pending messages, expected:%d, got:%d", 2, reopened.Pending())
+	}
+	expectNext(t, reopened, "2")
+	reopened.Commit()
+	appendMessages(t, reopened, "4")
+	expectNext(t, reopened, "3")
+	reopened.Commit()
+	expectNext(t, reopened, "4")
+}
+
+func TestSpoolFull(t *testing.T) {
+	s, dir := tempSpool(t, 1)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	body := strings.Repeat("x", 400<<10)
+	appendMessages(t, s, body, body)
+	if err := s.Append(Message{Body: body}); err != ErrFull {
+		t.Errorf("full spool should reject messages, got:%v", err)
+	}
+	s.Commit()
+	if err := s.Append(Message{Body: body}); err != nil {
+		t.Errorf("committed messages should free space, got:%v", err)
+	}
+	stats := s.Stats()
+	if stats.Messages != 2 || stats.Bytes > stats.MaxBytes || stats.MaxBytes != 1<<20 {
+		t.Errorf("wrong stats, got:%+v", stats)
+	}
+}
+
+func TestSpoolCompaction(t *testing.T) {
+	s, dir := tempSpool(t, 1)
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	body := strings.Repeat("x", 300<<10)
+	// the log never drains completely
+	for i := 0; i < 10; i++ {
+		appendMessages(t, s, fmt.Sprint(i)+body)
+		if i > 0 {
+			expectNext(t, s, fmt.Sprint(i-1)+body)
+			if err := s.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	info, _ := os.Stat(filepath.Join(dir, "test-rule", LogFile))
+	if info.Size() > 2<<20 {
+		t.Errorf("log should be compacted, got:%d bytes", info.Size())
+	}
+	expectNext(t, s, "9"+body)
+}
+
+func TestSpoolFail(t *testing.T) {
+	s, dir := tempSpool(t, 1)
+	defer os.RemoveAll(dir)
+	appendMessages(t, s, "1", "2")
+	if err := s.Fail(); err != nil {
+		t.Fatal(err)
+	}
+	expectNext(t, s, "2")
+	s.Close()
+	reopened := New(dir, 1)
+	if err := reopened.Open("test-rule"); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if stats := reopened.Stats(); stats.Failed != 1 || stats.Messages != 1 {
+		t.Errorf("wrong stats, got:%+v", stats)
+	}
+}
@@ -4,12 +4,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/phorest/rabbit-amazon-forwarder/consumer"
 	"github.com/phorest/rabbit-amazon-forwarder/mapping"
+	"github.com/phorest/rabbit-amazon-forwarder/redact"
 )
 
 const (
@@ -19,44 +27,113 @@ const (
 	acceptHeader = "Accept"
 	contentType  = "Content-Type"
 	acceptAll    = "*/*"
+	nameParam    = "name"
+	limitParam   = "limit"
+	headerParam  = "header"
+	dryRunParam  = "dryRun"
+	targetParam  = "target"
+	notFound     = "rule not found"
+	noResponse   = "rule is not responding"
+	noReplay     = "rule does not support dead-letter replay"
+	noInspect    = "rule does not support dead-letter inspection"
 )
 
 type response struct {
 	Healthy bool   `json:"healthy"`
 	Message string `json:"message"`
+	// Nodes broker node each rule is connected to
+	Nodes map[string]string `json:"nodes,omitempty"`
+	// States connection state of each rule
+	States map[string]string `json:"states,omitempty"`
+	// Breakers circuit breaker state of rules with a breaker
+	Breakers map[string]string `json:"breakers,omitempty"`
+	// Spools pending messages of rules with a spool
+	Spools map[string]consumer.SpoolStats `json:"spools,omitempty"`
+}
+
+type rule struct {
+	Name      string `json:"name"`
+	Consumer  string `json:"consumer"`
+	Forwarder string `json:"forwarder"`
+	Paused    bool   `json:"paused"`
+	Node      string `json:"node,omitempty"`
+	State     string `json:"state,omitempty"`
+	Breaker   string `json:"breaker,omitempty"`
+	Failed    bool   `json:"failed"`
+	Error     string `json:"error,omitempty"`
+
+	// Spool pending messages of rules with a spool
+	Spool *consumer.SpoolStats `json:"spool,omitempty"`
 }
 
 type consumerChannel struct {
-	name  string
-	check chan bool
-	stop  chan bool
+	name   string
+	entry  mapping.ConsumerForwarderMapping
+	check  chan bool
+	stop   chan bool
+	pause  chan bool
+	paused bool
+	// done closed when the consumer stops, err set before when it failed
+	done chan struct{}
+	err  error
+}
+
+// sendTimeout how long the supervisor waits for a busy consumer, e.g. one blocked forwarding a message
+var sendTimeout = 5 * time.Second
+
+// Loader interface for loading consumer->forwarder pairs
+type Loader interface {
+	Load() ([]mapping.ConsumerForwarderMapping, error)
 }
 
 // Client supervisor client
 type Client struct {
 	mappings  []mapping.ConsumerForwarderMapping
 	consumers map[string]*consumerChannel
+	loader    Loader
+	mutex     sync.Mutex
+	// changing serializes restarts and reloads, consumers are signalled without holding mutex
+	changing sync.Mutex
 }
 
-// New client for supervisor
-func New(consumerForwarderMapping []mapping.ConsumerForwarderMapping) Client {
-	return Client{mappings: consumerForwarderMapping}
+// New client for supervisor, loader is used to reload the mapping
+func New(consumerForwarderMapping []mapping.ConsumerForwarderMapping, loaders ...Loader) Client {
+	var loader Loader
+	loader = mapping.New()
+	if len(loaders) > 0 {
+		loader = loaders[0]
+	}
+	return Client{mappings: consumerForwarderMapping, loader: loader}
 }
 
 // Start starts supervisor
 func (c *Client) Start() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.consumers = make(map[string]*consumerChannel)
 	for _, mappingEntry := range c.mappings {
-		channel := makeConsumerChannel(mappingEntry.Forwarder.Name())
-		c.consumers[mappingEntry.Forwarder.Name()] = channel
-		go mappingEntry.Consumer.Start(mappingEntry.Forwarder, channel.check, channel.stop)
-		log.WithFields(log.Fields{
-			"consumerName":  mappingEntry.Consumer.Name(),
-			"forwarderName": mappingEntry.Forwarder.Name()}).Info("Started consumer with forwarder")
+		c.startConsumer(mappingEntry)
 	}
 	return nil
 }
 
+func (c *Client) startConsumer(mappingEntry mapping.ConsumerForwarderMapping) {
+	channel := makeConsumerChannel(mappingEntry)
+	c.consumers[channel.name] = channel
+	go func() {
+		channel.err = mappingEntry.Consumer.Start(mappingEntry.Forwarder, channel.check, channel.stop, channel.pause)
+		if channel.err != nil {
+			log.WithFields(log.Fields{
+				"ruleName": channel.name,
+				"error":    channel.err.Error()}).Error("Rule failed")
+		}
+		close(channel.done)
+	}()
+	log.WithFields(log.Fields{
+		"consumerName":  mappingEntry.Consumer.Name(),
+		"forwarderName": mappingEntry.Forwarder.Name()}).Info("Started consumer with forwarder")
+}
+
 // Check checks running consumers
 func (c *Client) Check(w http.ResponseWriter, r *http.Request) {
 	if accept := r.Header.Get(acceptHeader); accept != "" &&
@@ -67,12 +144,15 @@ func (c *Client) Check(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	stopped := 0
-	for _, consumer := range c.consumers {
-		if len(consumer.check) > 0 {
+	for _, consumer := range c.snapshot() {
+		if consumer.failed() || len(consumer.check) > 0 {
+			stopped = stopped + 1
+			continue
+		}
+		if !consumer.send(consumer.check, true) {
 			stopped = stopped + 1
 			continue
 		}
-		consumer.check <- true
 		time.Sleep(500 * time.Millisecond)
 		if len(consumer.check) > 0 {
 			stopped = stopped + 1
@@ -83,36 +163,406 @@ func (c *Client) Check(w http.ResponseWriter, r *http.Request) {
 		errorResponse(w, message)
 		return
 	}
-	successResponse(w)
+	c.mutex.Lock()
+	health := c.connections()
+	c.mutex.Unlock()
+	health.Healthy, health.Message = true, success
+	jsonResponse(w, 200, health)
 }
 
-// Restart restarts every consumer
+// connections connected broker node, connection state, circuit breaker state and spool
+// of every consumer reporting them
+func (c *Client) connections() response {
+	var health response
+	for name, consumerChannel := range c.consumers {
+		if reporter, ok := consumerChannel.entry.Consumer.(consumer.NodeReporter); ok {
+			if health.Nodes == nil {
+				health.Nodes = make(map[string]string)
+			}
+			health.Nodes[name] = reporter.Node()
+		}
+		if reporter, ok := consumerChannel.entry.Consumer.(consumer.StateReporter); ok {
+			if health.States == nil {
+				health.States = make(map[string]string)
+			}
+			health.States[name] = reporter.State()
+		}
+		if reporter, ok := consumerChannel.entry.Consumer.(consumer.BreakerReporter); ok && reporter.Breaker() != "" {
+			if health.Breakers == nil {
+				health.Breakers = make(map[string]string)
+			}
+			health.Breakers[name] = reporter.Breaker()
+		}
+		if reporter, ok := consumerChannel.entry.Consumer.(consumer.SpoolReporter); ok {
+			if stats, ok := reporter.SpoolStats(); ok {
+				if health.Spools == nil {
+					health.Spools = make(map[string]consumer.SpoolStats)
+				}
+				health.Spools[name] = stats
+			}
+		}
+	}
+	return health
+}
+
+// Restart restarts every consumer, consumers not responding keep running
 func (c *Client) Restart(w http.ResponseWriter, r *http.Request) {
-	c.stop()
-	if err := c.Start(); err != nil {
-		log.Error(err)
-		errorResponse(w, "")
+	c.changing.Lock()
+	defer c.changing.Unlock()
+	var notStopped []string
+	for _, consumer := range c.snapshot() {
+		if !c.restart(consumer) {
+			notStopped = append(notStopped, consumer.name)
+		}
+	}
+	if len(notStopped) > 0 {
+		sort.Strings(notStopped)
+		notRespondingResponse(w, strings.Join(notStopped, ", "))
 		return
 	}
 	successResponse(w)
 }
 
-func (c *Client) stop() {
+// Rules lists supervised rules and their state
+func (c *Client) Rules(w http.ResponseWriter, r *http.Request) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	rules := make([]rule, 0, len(c.consumers))
+	for _, consumerChannel := range c.consumers {
+		entry := rule{
+			Name:      consumerChannel.name,
+			Consumer:  consumerChannel.entry.Consumer.Name(),
+			Forwarder: consumerChannel.entry.Forwarder.Name(),
+			Paused:    consumerChannel.paused,
+			Failed:    consumerChannel.failed()}
+		if consumerChannel.failed() {
+			entry.Error = redact.URL(consumerChannel.err.Error())
+		}
+		if reporter, ok := consumerChannel.entry.Consumer.(consumer.NodeReporter); ok {
+			entry.Node = reporter.Node()
+		}
+		if reporter, ok := consumerChannel.entry.Consumer.(consumer.StateReporter); ok {
+			entry.State = reporter.State()
+		}
+		if reporter, ok := consumerChannel.entry.Consumer.(consumer.BreakerReporter); ok {
+			entry.Breaker = reporter.Breaker()
+		}
+		if reporter, ok := consumerChannel.entry.Consumer.(consumer.SpoolReporter); ok {
+			if stats, ok := reporter.SpoolStats(); ok {
+				entry.Spool = &stats
+			}
+		}
+		rules = append(rules, entry)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	jsonResponse(w, 200, rules)
+}
+
+// Pause stops consuming messages for a single rule without closing its connection
+func (c *Client) Pause(w http.ResponseWriter, r *http.Request) {
+	c.setPaused(w, r, true)
+}
+
+// Resume resumes consuming messages for a single paused rule
+func (c *Client) Resume(w http.ResponseWriter, r *http.Request) {
+	c.setPaused(w, r, false)
+}
+
+// RestartRule restarts a single consumer->forwarder pair
+func (c *Client) RestartRule(w http.ResponseWriter, r *http.Request) {
+	c.changing.Lock()
+	defer c.changing.Unlock()
+	consumer, ok := c.find(r.URL.Query().Get(nameParam))
+	if !ok {
+		notFoundResponse(w)
+		return
+	}
+	if !c.restart(consumer) {
+		notRespondingResponse(w, consumer.name)
+		return
+	}
+	successResponse(w)
+}
+
+// restart stops the consumer and starts it again, false when it did not receive the stop
+func (c *Client) restart(consumer *consumerChannel) bool {
+	log.WithField("ruleName", consumer.name).Info("Restarting rule")
+	if !consumer.send(consumer.stop, true) {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.consumers[consumer.name] == consumer {
+		c.startConsumer(consumer.entry)
+	}
+	return true
+}
+
+// ReplayDeadLetters moves messages from the rule's dead-letter queue back to the exchange
+// or through the forwarder, limit, header filters and dry run are passed as query parameters
+func (c *Client) ReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	consumerChannel, ok := c.find(query.Get(nameParam))
+	if !ok {
+		notFoundResponse(w)
+		return
+	}
+	replayer, ok := consumerChannel.entry.Consumer.(consumer.Replayer)
+	if !ok {
+		jsonResponse(w, 400, response{Healthy: false, Message: noReplay})
+		return
+	}
+	options, err := replayOptions(query)
+	if err != nil {
+		jsonResponse(w, 400, response{Healthy: false, Message: err.Error()})
+		return
+	}
+	log.WithFields(log.Fields{
+		"ruleName": consumerChannel.name,
+		"limit":    options.Limit,
+		"dryRun":   options.DryRun,
+		"target":   options.Target}).Info("Replaying dead-lettered messages")
+	result, err := replayer.Replay(consumerChannel.entry.Forwarder, options)
+	if err != nil {
+		errorResponse(w, fmt.Sprintf("%s, replayed %d messages", err.Error(), result.Replayed))
+		return
+	}
+	jsonResponse(w, 200, result)
+}
+
+// InspectDeadLetters returns the first messages of the rule's dead-letter queue,
+// the messages stay in the queue
+func (c *Client) InspectDeadLetters(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	consumerChannel, ok := c.find(query.Get(nameParam))
+	if !ok {
+		notFoundResponse(w)
+		return
+	}
+	inspector, ok := consumerChannel.entry.Consumer.(consumer.Inspector)
+	if !ok {
+		jsonResponse(w, 400, response{Healthy: false, Message: noInspect})
+		return
+	}
+	limit := consumer.DefaultInspectLimit
+	if value := query.Get(limitParam); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			jsonResponse(w, 400, response{Healthy: false, Message: fmt.Sprintf("invalid %s %q", limitParam, value)})
+			return
+		}
+	}
+	messages, err := inspector.Inspect(limit)
+	if err != nil {
+		errorResponse(w, err.Error())
+		return
+	}
+	jsonResponse(w, 200, messages)
+}
+
+func replayOptions(query url.Values) (consumer.ReplayOptions, error) {
+	options := consumer.ReplayOptions{Target: query.Get(targetParam)}
+	var err error
+	if value := query.Get(limitParam); value != "" {
+		if options.Limit, err = strconv.Atoi(value); err != nil || options.Limit < 0 {
+			return options, fmt.Errorf("invalid %s %q", limitParam, value)
+		}
+	}
+	if value := query.Get(dryRunParam); value != "" {
+		if options.DryRun, err = strconv.ParseBool(value); err != nil {
+			return options, fmt.Errorf("invalid %s %q", dryRunParam, value)
+		}
+	}
+	options.Headers, err = consumer.ParseHeaderFilter(query[headerParam])
+	return options, err
+}
+
+// Reload reloads the mapping and applies changed rules
+func (c *Client) Reload(w http.ResponseWriter, r *http.Request) {
+	if err := c.ReloadMappings(); err != nil {
+		errorResponse(w, err.Error())
+		return
+	}
+	successResponse(w)
+}
+
+// ReloadMappings loads the mapping again, starts added rules, stops removed ones
+// and restarts changed ones. Unchanged rules keep running without interruption, changed
+// rules not responding keep running with their previous definition until the next reload
+func (c *Client) ReloadMappings() error {
+	mappings, err := c.loader.Load()
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Could not reload mapping, keeping current rules")
+		return err
+	}
+	c.changing.Lock()
+	defer c.changing.Unlock()
+	loaded := make(map[string]mapping.ConsumerForwarderMapping)
+	for _, mappingEntry := range mappings {
+		loaded[mappingEntry.Forwarder.Name()] = mappingEntry
+	}
+	var notStopped []string
+	stopped := make(map[string]*consumerChannel)
+	for _, consumer := range c.snapshot() {
+		mappingEntry, ok := loaded[consumer.name]
+		if ok && reflect.DeepEqual(consumer.entry.Rule, mappingEntry.Rule) {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"ruleName": consumer.name,
+			"removed":  !ok}).Info("Stopping changed rule")
+		if !consumer.send(consumer.stop, true) {
+			log.WithField("ruleName", consumer.name).Error("Rule is not responding, keeping previous definition")
+			notStopped = append(notStopped, consumer.name)
+			continue
+		}
+		stopped[consumer.name] = consumer
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for name, consumer := range stopped {
+		if c.consumers[name] == consumer {
+			delete(c.consumers, name)
+		}
+	}
+	c.mappings = nil
+	for _, mappingEntry := range mappings {
+		if consumer, ok := c.consumers[mappingEntry.Forwarder.Name()]; ok {
+			c.mappings = append(c.mappings, consumer.entry)
+			continue
+		}
+		c.startConsumer(mappingEntry)
+		c.mappings = append(c.mappings, mappingEntry)
+	}
+	log.WithField("rules", len(c.mappings)).Info("Reloaded mapping")
+	if len(notStopped) > 0 {
+		sort.Strings(notStopped)
+		return fmt.Errorf("%s: %s", noResponse, strings.Join(notStopped, ", "))
+	}
+	return nil
+}
+
+// Watch reloads the mapping whenever the mapping file or directory changes
+func (c *Client) Watch(mappingPath string, interval time.Duration) {
+	log.WithFields(log.Fields{
+		"mappingPath": mappingPath,
+		"interval":    interval.String()}).Info("Watching mapping")
+	last, _ := signature(mappingPath)
+	for range time.Tick(interval) {
+		current, err := signature(mappingPath)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"mappingPath": mappingPath,
+				"error":       err.Error()}).Warn("Could not check mapping")
+			continue
+		}
+		if current == last {
+			continue
+		}
+		last = current
+		log.WithField("mappingPath", mappingPath).Info("Mapping changed")
+		c.ReloadMappings()
+	}
+}
+
+// signature of the mapping file or every mapping file in the directory
+func signature(mappingPath string) (string, error) {
+	info, err := os.Stat(mappingPath)
+	if err != nil {
+		return "", err
+	}
+	files := []string{mappingPath}
+	if info.IsDir() {
+		if files, err = mapping.DirectoryFiles(mappingPath); err != nil {
+			return "", err
+		}
+	}
+	var parts []string
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", file, info.ModTime().UnixNano(), info.Size()))
+	}
+	return strings.Join(parts, ","), nil
+}
+
+func (c *Client) setPaused(w http.ResponseWriter, r *http.Request, pause bool) {
+	consumer, ok := c.find(r.URL.Query().Get(nameParam))
+	if !ok {
+		notFoundResponse(w)
+		return
+	}
+	log.WithFields(log.Fields{
+		"ruleName": consumer.name,
+		"paused":   pause}).Info("Changing rule state")
+	if !consumer.send(consumer.pause, pause) {
+		notRespondingResponse(w, consumer.name)
+		return
+	}
+	c.mutex.Lock()
+	consumer.paused = pause
+	c.mutex.Unlock()
+	successResponse(w)
+}
+
+// find supervised consumer of the rule
+func (c *Client) find(name string) (*consumerChannel, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	consumer, ok := c.consumers[name]
+	return consumer, ok
+}
+
+// snapshot supervised consumers, they are signalled without holding the mutex so a busy
+// consumer does not block the other rules
+func (c *Client) snapshot() []*consumerChannel {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	consumers := make([]*consumerChannel, 0, len(c.consumers))
 	for _, consumer := range c.consumers {
-		consumer.stop <- true
+		consumers = append(consumers, consumer)
+	}
+	return consumers
+}
+
+// send delivers the value unless the consumer has already stopped, false when the
+// consumer did not receive it in time
+func (c *consumerChannel) send(channel chan bool, value bool) bool {
+	timer := time.NewTimer(sendTimeout)
+	defer timer.Stop()
+	select {
+	case channel <- value:
+	case <-c.done:
+	case <-timer.C:
+		log.WithField("ruleName", c.name).Warn("Rule is not responding")
+		return false
+	}
+	return true
+}
+
+// failed whether the consumer stopped on its own with an error
+func (c *consumerChannel) failed() bool {
+	select {
+	case <-c.done:
+		return c.err != nil
+	default:
+		return false
 	}
 }
 
-func makeConsumerChannel(name string) *consumerChannel {
+func makeConsumerChannel(entry mapping.ConsumerForwarderMapping) *consumerChannel {
 	check := make(chan bool)
 	stop := make(chan bool)
-	return &consumerChannel{name: name, check: check, stop: stop}
+	pause := make(chan bool)
+	return &consumerChannel{name: entry.Forwarder.Name(), entry: entry, check: check, stop: stop, pause: pause, done: make(chan struct{})}
 }
 
 func errorResponse(w http.ResponseWriter, message string) {
 	w.Header().Set(contentType, jsonType)
 	w.WriteHeader(500)
-	w.Write([]byte(message))
+	w.Write([]byte(redact.URL(message)))
 }
 
 func notAcceptableResponse(w http.ResponseWriter) {
@@ -127,6 +577,26 @@ func notAcceptableResponse(w http.ResponseWriter) {
 	w.Write(bytes)
 }
 
+func notRespondingResponse(w http.ResponseWriter, names string) {
+	jsonResponse(w, 503, response{Healthy: false, Message: fmt.Sprintf("%s: %s", noResponse, names)})
+}
+
+func notFoundResponse(w http.ResponseWriter) {
+	jsonResponse(w, 404, response{Healthy: false, Message: notFound})
+}
+
+func jsonResponse(w http.ResponseWriter, code int, body interface{}) {
+	bytes, err := json.Marshal(body)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set(contentType, jsonType)
+	w.WriteHeader(code)
+	w.Write(bytes)
+}
+
 func successResponse(w http.ResponseWriter) {
 	w.Header().Set(contentType, jsonType)
 	w.WriteHeader(200)